@@ -1,18 +1,23 @@
 package main
 
 import (
+	"aspen/auth"
 	"aspen/config"
 	"aspen/logging"
 	"aspen/middleware"
 	"aspen/resources"
 	"aspen/router"
 	"aspen/router/service"
+	"bufio"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -21,6 +26,7 @@ import (
 
 var serverPort = flag.Int("port", 8080, "the port to open this server on")
 var serviceFolder = flag.String("services", "./services", "the folder to place service files in")
+var hashPassword = flag.Bool("hash-password", false, "read a password from stdin, print its hash for the Users config, and exit")
 
 func main() {
 	// Init
@@ -30,6 +36,11 @@ func main() {
 	resources.RegisterResources()
 	flag.Parse()
 
+	if *hashPassword {
+		printPasswordHash()
+		return
+	}
+
 	// Set service folder
 	service.SetGlobalFolder(*serviceFolder)
 
@@ -46,6 +57,13 @@ func main() {
 	// Load config
 	instance, err := config.ParseGlobalConfig()
 	if err != nil {
+		var report *router.ValidationReport
+		if errors.As(err, &report) {
+			for _, issue := range report.Issues {
+				log.Error().Str("route", issue.Route).Str("field", issue.Field).Msg(issue.Message)
+			}
+			log.Fatal().Int("issues", len(report.Issues)).Msg("Config is not valid")
+		}
 		log.Fatal().Err(err).Msg("Error loading config")
 	}
 
@@ -68,6 +86,11 @@ func main() {
 		Addr:    fmt.Sprintf(":%d", *serverPort),
 		Handler: &router.GlobalRouter,
 	}
+
+	// Accept cleartext HTTP/2 (h2c) alongside HTTP/1, so gRPC clients can connect
+	server.Protocols = new(http.Protocols)
+	server.Protocols.SetHTTP1(true)
+	server.Protocols.SetUnencryptedHTTP2(true)
 	go func() {
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Fatal().Err(err).Msg("Server failed")
@@ -94,3 +117,17 @@ func main() {
 
 	log.Info().Msg("Server shutdown complete")
 }
+
+// printPasswordHash hashes the first line of stdin, for the PasswordHash of a user.
+func printPasswordHash() {
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		log.Fatal().Err(err).Msg("Error reading password")
+	}
+
+	hash, err := auth.HashPassword(strings.TrimRight(password, "\r\n"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error hashing password")
+	}
+	fmt.Println(hash)
+}
@@ -0,0 +1,22 @@
+package auth
+
+import "slices"
+
+// Access decides which roles may use each resource, by resource ID.
+type Access struct {
+	// Roles allowed on a resource. A user needs at least one of them.
+	// Resources without an entry are open to any authenticated user.
+	Roles map[string][]string
+	// Resources open to everyone, authenticated or not
+	Public []string
+}
+
+// IsPublic reports whether a resource can be used without authenticating.
+func (a Access) IsPublic(resourceID string) bool {
+	return slices.Contains(a.Public, resourceID)
+}
+
+// Allows reports whether an identity may use a resource.
+func (a Access) Allows(identity *Identity, resourceID string) bool {
+	return identity.HasAnyRole(a.Roles[resourceID])
+}
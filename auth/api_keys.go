@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// APIKeyPrefix starts every API key, so they are easy to recognise, e.g. by secret scanners.
+const APIKeyPrefix = "aspen_"
+
+// APIKey is a long-lived credential for machine clients. Only a hash of its secret is kept.
+type APIKey struct {
+	// Public part of the key, used to find it
+	ID   string
+	Name string
+	// Hex encoded SHA-256 of the secret. Secrets are random, so a slow hash isn't needed.
+	Hash  string
+	Roles []string
+	// Zero if the key doesn't expire
+	Expires time.Time
+}
+
+// GenerateAPIKey creates a new key, returning the token to give to the client once, and the key to keep.
+func GenerateAPIKey(name string, roles []string, expires time.Time) (string, APIKey) {
+	id := make([]byte, 8)
+	rand.Read(id)
+	secret := RandomToken()
+
+	key := APIKey{
+		ID:      hex.EncodeToString(id),
+		Name:    name,
+		Hash:    hashAPIKeySecret(secret),
+		Roles:   roles,
+		Expires: expires,
+	}
+	return APIKeyPrefix + key.ID + "_" + secret, key
+}
+
+func hashAPIKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseAPIKey splits a token into the ID and secret of its key.
+func parseAPIKey(token string) (id, secret string, ok bool) {
+	rest, ok := strings.CutPrefix(token, APIKeyPrefix)
+	if !ok {
+		return "", "", false
+	}
+	return strings.Cut(rest, "_")
+}
+
+// APIKeys is the API key store of a config. It remembers when keys are used, so their last use can be recorded.
+type APIKeys struct {
+	keys map[string]APIKey
+
+	lock sync.Mutex
+	// When each key was last used, and the uses that haven't been taken yet
+	used    map[string]time.Time
+	pending map[string]time.Time
+}
+
+// NewAPIKeys creates an API key store, checking that IDs are unique and hashes are well formed.
+func NewAPIKeys(keys []APIKey) (*APIKeys, error) {
+	store := &APIKeys{
+		keys:    make(map[string]APIKey),
+		used:    make(map[string]time.Time),
+		pending: make(map[string]time.Time),
+	}
+	for _, key := range keys {
+		if key.ID == "" || strings.Contains(key.ID, "_") {
+			return nil, fmt.Errorf("API key \"%s\" has an invalid ID \"%s\"", key.Name, key.ID)
+		}
+		if _, ok := store.keys[key.ID]; ok {
+			return nil, fmt.Errorf("API key \"%s\" is defined more than once", key.ID)
+		}
+		if hash, err := hex.DecodeString(key.Hash); err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("API key \"%s\" has an invalid hash", key.ID)
+		}
+		store.keys[key.ID] = key
+	}
+	return store, nil
+}
+
+// Authenticate checks a token, returning its key if the key exists and hasn't expired.
+func (k *APIKeys) Authenticate(token string) (APIKey, bool) {
+	if k == nil {
+		return APIKey{}, false
+	}
+	id, secret, ok := parseAPIKey(token)
+	if !ok {
+		return APIKey{}, false
+	}
+	key, ok := k.keys[id]
+	if !ok || !TokensEqual(hashAPIKeySecret(secret), key.Hash) {
+		return APIKey{}, false
+	}
+	now := time.Now()
+	if !key.Expires.IsZero() && !now.Before(key.Expires) {
+		return APIKey{}, false
+	}
+
+	k.lock.Lock()
+	k.used[id] = now
+	k.pending[id] = now
+	k.lock.Unlock()
+	return key, true
+}
+
+// LastUsed returns when a key was last used, if it has been since the store was created.
+func (k *APIKeys) LastUsed(id string) (time.Time, bool) {
+	if k == nil {
+		return time.Time{}, false
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	used, ok := k.used[id]
+	return used, ok
+}
+
+// TakeUsed returns when keys were last used, for the keys used since the last call.
+func (k *APIKeys) TakeUsed() map[string]time.Time {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	pending := k.pending
+	k.pending = make(map[string]time.Time)
+	return pending
+}
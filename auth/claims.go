@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Claims are the decoded claims of a token.
+type Claims map[string]any
+
+// Lookup returns a claim by name. A dotted name like "realm_access.roles" looks inside nested objects.
+func (c Claims) Lookup(name string) (any, bool) {
+	if value, ok := c[name]; ok {
+		return value, true
+	}
+
+	var value any = map[string]any(c)
+	for _, part := range strings.Split(name, ".") {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if value, ok = object[part]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// String returns a claim as text. Numbers and booleans are formatted, and lists are joined with commas.
+func (c Claims) String(name string) (string, bool) {
+	value, ok := c.Lookup(name)
+	if !ok || value == nil {
+		return "", false
+	}
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case []any:
+		return strings.Join(c.Strings(name), ","), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	default:
+		return "", false
+	}
+}
+
+// Strings returns a claim holding a list of strings, or a space separated string like "scope".
+func (c Claims) Strings(name string) []string {
+	value, _ := c.Lookup(name)
+	switch v := value.(type) {
+	case string:
+		return strings.Fields(v)
+	case []any:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
+
+// MapRoles turns the values of a claim, like groups, into Aspen roles. Without a mapping the values are used as roles,
+// and with one, values that aren't mapped are dropped.
+func MapRoles(values []string, mapping map[string][]string) []string {
+	if mapping == nil {
+		return values
+	}
+
+	var roles []string
+	for _, value := range values {
+		for _, role := range mapping[value] {
+			if !slices.Contains(roles, role) {
+				roles = append(roles, role)
+			}
+		}
+	}
+	return roles
+}
@@ -0,0 +1,20 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+)
+
+// identityKey is used to pass the Identity of a request through its context.
+type identityKey struct{}
+
+// WithIdentity returns a copy of the request carrying the identity.
+func WithIdentity(req *http.Request, identity *Identity) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), identityKey{}, identity))
+}
+
+// RequestIdentity returns the identity a request was authenticated as, or nil.
+func RequestIdentity(req *http.Request) *Identity {
+	identity, _ := req.Context().Value(identityKey{}).(*Identity)
+	return identity
+}
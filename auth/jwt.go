@@ -0,0 +1,367 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Supported JWT signing algorithms
+const (
+	HS256 = "HS256"
+	RS256 = "RS256"
+	ES256 = "ES256"
+)
+
+// MinHMACKeyLength is the shortest HS256 secret accepted, the size of the hash.
+const MinHMACKeyLength = 32
+
+// JWTKey is a key that verifies tokens signed with one algorithm.
+type JWTKey struct {
+	// Matched against the "kid" header of tokens, if both are set
+	ID        string
+	Algorithm string
+	// []byte for HS256, *rsa.PublicKey for RS256 and *ecdsa.PublicKey for ES256
+	Key any
+}
+
+// NewJWTKey checks that a key suits its algorithm.
+func NewJWTKey(id, algorithm string, key any) (JWTKey, error) {
+	switch k := key.(type) {
+	case []byte:
+		if algorithm != HS256 {
+			return JWTKey{}, fmt.Errorf("secret keys can only be used with %s", HS256)
+		}
+		if len(k) < MinHMACKeyLength {
+			return JWTKey{}, fmt.Errorf("%s secret must be at least %d bytes", HS256, MinHMACKeyLength)
+		}
+	case *rsa.PublicKey:
+		if algorithm != RS256 {
+			return JWTKey{}, fmt.Errorf("RSA keys can only be used with %s", RS256)
+		}
+		if k.N.BitLen() < 2048 {
+			return JWTKey{}, fmt.Errorf("RSA keys must be at least 2048 bits")
+		}
+	case *ecdsa.PublicKey:
+		if algorithm != ES256 {
+			return JWTKey{}, fmt.Errorf("EC keys can only be used with %s", ES256)
+		}
+		if k.Curve != elliptic.P256() {
+			return JWTKey{}, fmt.Errorf("%s keys must use the P-256 curve", ES256)
+		}
+	default:
+		return JWTKey{}, fmt.Errorf("unsupported key type %T", key)
+	}
+	return JWTKey{ID: id, Algorithm: algorithm, Key: key}, nil
+}
+
+// ParsePublicKey reads a PEM encoded RSA or EC public key, or a certificate holding one.
+func ParsePublicKey(data []byte) (any, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	}
+}
+
+// KeyAlgorithm returns the JWT algorithm matching a public key.
+func KeyAlgorithm(key any) (string, error) {
+	switch key.(type) {
+	case *rsa.PublicKey:
+		return RS256, nil
+	case *ecdsa.PublicKey:
+		return ES256, nil
+	default:
+		return "", fmt.Errorf("unsupported public key type %T", key)
+	}
+}
+
+// jwk is a JSON Web Key, with the fields of the key types we support.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	// Symmetric
+	K string `json:"k"`
+}
+
+// ParseJWKS reads the signing keys of a JSON Web Key Set. Keys for encryption, and of unsupported types, are skipped.
+func ParseJWKS(data []byte) ([]JWTKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("error parsing JWKS: %w", err)
+	}
+
+	var keys []JWTKey
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, algorithm, err := k.parse()
+		if err != nil {
+			return nil, fmt.Errorf("key %d of JWKS: %w", i, err)
+		}
+		if key == nil || (k.Alg != "" && k.Alg != algorithm) {
+			continue
+		}
+		jwtKey, err := NewJWTKey(k.Kid, algorithm, key)
+		if err != nil {
+			return nil, fmt.Errorf("key %d of JWKS: %w", i, err)
+		}
+		keys = append(keys, jwtKey)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("JWKS has no supported signing keys")
+	}
+	return keys, nil
+}
+
+// parse returns the key and its algorithm, or a nil key if its type isn't supported.
+func (k jwk) parse() (any, string, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid modulus: %w", err)
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil || !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, "", fmt.Errorf("invalid exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, RS256, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, "", nil
+		}
+		x, errX := decodeBigInt(k.X)
+		y, errY := decodeBigInt(k.Y)
+		if errX != nil || errY != nil {
+			return nil, "", fmt.Errorf("invalid EC point")
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		if !key.Curve.IsOnCurve(x, y) {
+			return nil, "", fmt.Errorf("EC point is not on the curve")
+		}
+		return key, ES256, nil
+	case "oct":
+		secret, err := base64.RawURLEncoding.DecodeString(k.K)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid secret: %w", err)
+		}
+		return secret, HS256, nil
+	default:
+		return nil, "", nil
+	}
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty value")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+// Errors returned when a token is rejected
+var (
+	ErrMalformedToken   = errors.New("malformed token")
+	ErrInvalidSignature = errors.New("invalid token signature")
+	ErrTokenExpired     = errors.New("token has expired")
+	ErrNoExpiry         = errors.New("token has no expiry")
+	ErrTokenNotYetValid = errors.New("token is not valid yet")
+	ErrInvalidIssuer    = errors.New("token has the wrong issuer")
+	ErrInvalidAudience  = errors.New("token has the wrong audience")
+)
+
+// JWTVerifier checks the signature and registered claims of tokens.
+type JWTVerifier struct {
+	Keys []JWTKey
+	// Required "iss" claim, if set
+	Issuer string
+	// The "aud" claim must include one of these, if set
+	Audience []string
+	// Clock skew allowed when checking "exp" and "nbf"
+	Leeway time.Duration
+	// Accept tokens without an "exp" claim, which are valid forever
+	AllowNoExpiry bool
+}
+
+// Verify checks a compact serialized JWT, returning its claims if it is valid.
+func (v *JWTVerifier) Verify(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformedToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrMalformedToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+
+	// Keys are bound to an algorithm, so a token can't pick a weaker one, like "none" or HS256 with a public key
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, key := range v.Keys {
+		if key.Algorithm != header.Alg || (header.Kid != "" && key.ID != "" && key.ID != header.Kid) {
+			continue
+		}
+		if verifySignature(key, signed, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, ErrInvalidSignature
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil || claims == nil {
+		return nil, ErrMalformedToken
+	}
+	if err := v.checkClaims(claims, time.Now()); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (v *JWTVerifier) checkClaims(claims Claims, now time.Time) error {
+	if exp, ok := claims["exp"]; !ok {
+		if !v.AllowNoExpiry {
+			return ErrNoExpiry
+		}
+	} else {
+		seconds, ok := exp.(float64)
+		if !ok {
+			return ErrMalformedToken
+		}
+		if !now.Before(unixTime(seconds).Add(v.Leeway)) {
+			return ErrTokenExpired
+		}
+	}
+	if nbf, ok := claims["nbf"]; ok {
+		seconds, ok := nbf.(float64)
+		if !ok {
+			return ErrMalformedToken
+		}
+		if now.Add(v.Leeway).Before(unixTime(seconds)) {
+			return ErrTokenNotYetValid
+		}
+	}
+	if v.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != v.Issuer {
+			return ErrInvalidIssuer
+		}
+	}
+	if len(v.Audience) > 0 {
+		audiences, ok := tokenAudiences(claims)
+		if !ok {
+			return ErrMalformedToken
+		}
+		if !slices.ContainsFunc(audiences, func(aud string) bool { return slices.Contains(v.Audience, aud) }) {
+			return ErrInvalidAudience
+		}
+	}
+	return nil
+}
+
+// tokenAudiences reads the "aud" claim, which is a single audience or a list of them. Unlike Claims.Strings,
+// a string isn't split on spaces, so "evil aspen" doesn't match "aspen".
+func tokenAudiences(claims Claims) ([]string, bool) {
+	switch aud := claims["aud"].(type) {
+	case nil:
+		return nil, true
+	case string:
+		return []string{aud}, true
+	case []any:
+		audiences := make([]string, len(aud))
+		for i, item := range aud {
+			s, ok := item.(string)
+			if !ok {
+				return nil, false
+			}
+			audiences[i] = s
+		}
+		return audiences, true
+	default:
+		return nil, false
+	}
+}
+
+func unixTime(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
+
+func decodeSegment(segment string, value any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
+
+func verifySignature(key JWTKey, signed, signature []byte) bool {
+	digest := sha256.Sum256(signed)
+	switch k := key.Key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), signature)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature) == nil
+	case *ecdsa.PublicKey:
+		// JWS uses the raw r || s encoding, not ASN.1
+		if len(signature) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(k, digest[:], r, s)
+	default:
+		return false
+	}
+}
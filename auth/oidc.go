@@ -0,0 +1,263 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long to wait between fetching the keys of a provider again, when a token is signed with an unknown key
+const oidcKeysRefreshInterval = time.Minute
+
+// Responses from providers larger than this are rejected
+const oidcMaxResponseBytes = 1 << 20
+
+// OIDCProvider is an OpenID Connect provider that users log in with, using the authorization code flow with PKCE.
+// Its endpoints are discovered from the issuer on first use.
+type OIDCProvider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// Where the provider sends users back to with a code
+	RedirectURL string
+	Scopes      []string
+	// Clock skew allowed when checking ID tokens
+	Leeway time.Duration
+	Client *http.Client
+
+	lock        sync.Mutex
+	metadata    *oidcMetadata
+	keys        []JWTKey
+	keysFetched time.Time
+}
+
+// oidcMetadata is the part of a provider's discovery document we use.
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+}
+
+// RandomToken returns a random URL-safe string, for states, nonces and PKCE verifiers.
+func RandomToken() string {
+	data := make([]byte, 32)
+	rand.Read(data)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// PKCEChallenge returns the S256 code challenge of a PKCE verifier.
+func PKCEChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// TokensEqual compares two secrets in constant time.
+func TokensEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// AuthCodeURL returns the provider URL that starts a login.
+func (p *OIDCProvider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	authURL, err := url.Parse(metadata.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid authorization endpoint: %w", err)
+	}
+	query := authURL.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", p.ClientID)
+	query.Set("redirect_uri", p.RedirectURL)
+	query.Set("scope", strings.Join(p.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", PKCEChallenge(verifier))
+	query.Set("code_challenge_method", "S256")
+	authURL.RawQuery = query.Encode()
+	return authURL.String(), nil
+}
+
+// EndSessionURL returns the provider's logout endpoint, if it has one.
+func (p *OIDCProvider) EndSessionURL(ctx context.Context) string {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return ""
+	}
+	return metadata.EndSessionEndpoint
+}
+
+// Exchange trades an authorization code for the ID token of the user, which is verified against the nonce.
+func (p *OIDCProvider) Exchange(ctx context.Context, code, verifier, nonce string) (Claims, error) {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	if p.ClientSecret == "" {
+		form.Set("client_id", p.ClientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	status, err := p.fetchJSON(req, &tokens)
+	if err != nil {
+		return nil, fmt.Errorf("error exchanging code: %w", err)
+	}
+	if status != http.StatusOK || tokens.Error != "" {
+		return nil, fmt.Errorf("token endpoint responded %d: %s %s", status, tokens.Error, tokens.ErrorDescription)
+	}
+	if tokens.IDToken == "" {
+		return nil, errors.New("token response has no ID token")
+	}
+
+	return p.VerifyIDToken(ctx, tokens.IDToken, nonce)
+}
+
+// VerifyIDToken checks the signature, issuer, audience, expiry and nonce of an ID token.
+func (p *OIDCProvider) VerifyIDToken(ctx context.Context, token, nonce string) (Claims, error) {
+	keys, err := p.signingKeys(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	verifier := &JWTVerifier{Keys: keys, Issuer: p.Issuer, Audience: []string{p.ClientID}, Leeway: p.Leeway}
+	claims, err := verifier.Verify(token)
+	if errors.Is(err, ErrInvalidSignature) {
+		// The provider may have rotated its keys
+		if keys, refreshErr := p.signingKeys(ctx, true); refreshErr == nil {
+			verifier.Keys = keys
+			claims, err = verifier.Verify(token)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if tokenNonce, _ := claims["nonce"].(string); !TokensEqual(tokenNonce, nonce) {
+		return nil, errors.New("ID token has the wrong nonce")
+	}
+	return claims, nil
+}
+
+// discover fetches the provider's discovery document, which is kept once it has been read.
+func (p *OIDCProvider) discover(ctx context.Context) (*oidcMetadata, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+
+	discoveryURL := strings.TrimSuffix(p.Issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, discoveryURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	var metadata oidcMetadata
+	status, err := p.fetchJSON(req, &metadata)
+	if err != nil {
+		return nil, fmt.Errorf("error discovering OIDC provider: %w", err)
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("OIDC discovery responded %d", status)
+	}
+	if metadata.Issuer != p.Issuer {
+		return nil, fmt.Errorf("OIDC provider is for issuer \"%s\", not \"%s\"", metadata.Issuer, p.Issuer)
+	}
+	if metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" || metadata.JWKSURI == "" {
+		return nil, errors.New("OIDC discovery is missing the authorization, token or JWKS endpoint")
+	}
+
+	p.metadata = &metadata
+	return p.metadata, nil
+}
+
+// signingKeys returns the provider's keys, fetching them if they haven't been yet or if refresh is set.
+// Refreshes are limited, so tokens with unknown keys can't make us hammer the provider.
+func (p *OIDCProvider) signingKeys(ctx context.Context, refresh bool) ([]JWTKey, error) {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.keys != nil && (!refresh || time.Since(p.keysFetched) < oidcKeysRefreshInterval) {
+		return p.keys, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, metadata.JWKSURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	var raw json.RawMessage
+	status, err := p.fetchJSON(req, &raw)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching OIDC keys: %w", err)
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("OIDC JWKS endpoint responded %d", status)
+	}
+	keys, err := ParseJWKS(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	p.keys = keys
+	p.keysFetched = time.Now()
+	return keys, nil
+}
+
+// fetchJSON sends a request and decodes its JSON response, returning the response status.
+func (p *OIDCProvider) fetchJSON(req *http.Request, value any) (int, error) {
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, oidcMaxResponseBytes))
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if err := json.Unmarshal(data, value); err != nil {
+		return resp.StatusCode, fmt.Errorf("invalid JSON response: %w", err)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Parameters for new argon2id hashes, following the OWASP recommendation
+const (
+	argon2Memory  = 19 * 1024 // KiB
+	argon2Time    = 2
+	argon2Threads = 1
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+)
+
+// MinPasswordLength is the shortest password accepted for new hashes.
+const MinPasswordLength = 8
+
+// HashPassword hashes a password with argon2id, in the PHC string format:
+// $argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>
+func HashPassword(password string) (string, error) {
+	if len(password) < MinPasswordLength {
+		return "", fmt.Errorf("password must be at least %d characters", MinPasswordLength)
+	}
+
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("error generating salt: %w", err)
+	}
+	key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+
+	encoding := base64.RawStdEncoding
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, argon2Memory, argon2Time, argon2Threads, encoding.EncodeToString(salt), encoding.EncodeToString(key)), nil
+}
+
+// CheckPasswordHash checks that a hash is in a supported format: argon2id, or bcrypt ($2a$, $2b$ or $2y$).
+func CheckPasswordHash(hash string) error {
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		_, err := parseArgon2(hash)
+		return err
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		_, err := bcrypt.Cost([]byte(hash))
+		return err
+	default:
+		return errors.New("unsupported password hash, expected argon2id or bcrypt")
+	}
+}
+
+// VerifyPassword reports whether a password matches an argon2id or bcrypt hash.
+func VerifyPassword(hash, password string) bool {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		params, err := parseArgon2(hash)
+		if err != nil {
+			return false
+		}
+		key := argon2.IDKey([]byte(password), params.salt, params.time, params.memory, params.threads, uint32(len(params.key)))
+		return subtle.ConstantTimeCompare(key, params.key) == 1
+	}
+
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+type argon2Params struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+func parseArgon2(hash string) (argon2Params, error) {
+	var params argon2Params
+
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return params, errors.New("malformed argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, fmt.Errorf("unsupported argon2id version '%s'", parts[2])
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads); err != nil {
+		return params, fmt.Errorf("malformed argon2id parameters '%s'", parts[3])
+	}
+	if params.memory == 0 || params.time == 0 || params.threads == 0 {
+		return params, fmt.Errorf("invalid argon2id parameters '%s'", parts[3])
+	}
+
+	var err error
+	if params.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return params, fmt.Errorf("malformed argon2id salt: %w", err)
+	}
+	if params.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(params.key) == 0 {
+		return params, errors.New("malformed argon2id key")
+	}
+	return params, nil
+}
@@ -0,0 +1,244 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// MinSessionSecretLength is the shortest secret accepted for session cookies.
+const MinSessionSecretLength = 32
+
+// SessionOptions configures session cookies.
+type SessionOptions struct {
+	CookieName string
+	// Domain of the cookie. Empty means the host that set it.
+	Domain string
+	// How long a session lasts without being renewed
+	MaxAge time.Duration
+	// Sessions older than this are reissued with a new expiry on their next request
+	RotateAfter time.Duration
+	Secure      bool
+	SameSite    http.SameSite
+}
+
+// DefaultSessionOptions returns secure cookies named "aspen_session", lasting 12h and renewed every 15m.
+func DefaultSessionOptions() SessionOptions {
+	return SessionOptions{
+		CookieName:  "aspen_session",
+		MaxAge:      12 * time.Hour,
+		RotateAfter: 15 * time.Minute,
+		Secure:      true,
+		SameSite:    http.SameSiteLaxMode,
+	}
+}
+
+// Session is the content of a session cookie.
+type Session struct {
+	Username string `json:"u"`
+	Issued   int64  `json:"i"`
+	Expires  int64  `json:"e"`
+	// Fingerprint of the user's password hash, so changing the password ends the user's sessions
+	Fingerprint string `json:"f"`
+}
+
+// Sessions issues and reads session cookies, which are encrypted and authenticated with AES-GCM.
+type Sessions struct {
+	aead    cipher.AEAD
+	options SessionOptions
+}
+
+// A key for configs without a session secret. It is shared by every config of the process,
+// so sessions survive reloads but not restarts.
+var processKey = sync.OnceValue(func() []byte {
+	log.Warn().Msg("No session secret is configured, sessions will end when Aspen restarts")
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+})
+
+// NewSessions creates a session cookie issuer. The key is derived from the secret, or is random
+// for the lifetime of the process if the secret is empty.
+func NewSessions(secret string, options SessionOptions) (*Sessions, error) {
+	var key []byte
+	switch {
+	case secret == "":
+		key = processKey()
+	case len(secret) < MinSessionSecretLength:
+		return nil, fmt.Errorf("session secret must be at least %d characters", MinSessionSecretLength)
+	default:
+		sum := sha256.Sum256([]byte(secret))
+		key = sum[:]
+	}
+	if options.CookieName == "" {
+		return nil, fmt.Errorf("session cookie has no name")
+	}
+	if options.MaxAge <= 0 {
+		return nil, fmt.Errorf("session max age must be positive")
+	}
+	if options.SameSite == http.SameSiteNoneMode && !options.Secure {
+		return nil, fmt.Errorf("SameSite=None cookies must be secure")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Sessions{aead: aead, options: options}, nil
+}
+
+// Write starts a new session for the user, replacing any session cookie the client has.
+func (s *Sessions) Write(w http.ResponseWriter, user User) error {
+	now := time.Now()
+	session := Session{
+		Username:    user.Username,
+		Issued:      now.Unix(),
+		Expires:     now.Add(s.options.MaxAge).Unix(),
+		Fingerprint: fingerprint(user.PasswordHash),
+	}
+	cookie, err := s.Seal(s.options.CookieName, session, s.options.MaxAge)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, cookie)
+	return nil
+}
+
+// Clear ends the session by deleting the cookie.
+func (s *Sessions) Clear(w http.ResponseWriter) {
+	http.SetCookie(w, s.Expire(s.options.CookieName))
+}
+
+// CookieName returns the name of the session cookie.
+func (s *Sessions) CookieName() string {
+	return s.options.CookieName
+}
+
+// MaxAge returns how long sessions last.
+func (s *Sessions) MaxAge() time.Duration {
+	return s.options.MaxAge
+}
+
+// Seal encrypts a value into a cookie lasting maxAge, with the flags of session cookies.
+func (s *Sessions) Seal(name string, value any, maxAge time.Duration) (*http.Cookie, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	// The cookie name is authenticated too, so a value can't be moved to another cookie
+	sealed := s.aead.Seal(nonce, nonce, data, []byte(name))
+	return s.cookie(name, base64.RawURLEncoding.EncodeToString(sealed), maxAge), nil
+}
+
+// Open decrypts a cookie made by Seal into value, reporting whether the request had a valid one.
+func (s *Sessions) Open(req *http.Request, name string, value any) bool {
+	cookie, err := req.Cookie(name)
+	if err != nil {
+		return false
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil || len(sealed) < s.aead.NonceSize() {
+		return false
+	}
+	nonce, ciphertext := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+	data, err := s.aead.Open(nil, nonce, ciphertext, []byte(name))
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(data, value) == nil
+}
+
+// Expire returns a cookie that deletes the named cookie.
+func (s *Sessions) Expire(name string) *http.Cookie {
+	return s.cookie(name, "", -1)
+}
+
+func (s *Sessions) cookie(name, value string, maxAge time.Duration) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Domain:   s.options.Domain,
+		Secure:   s.options.Secure,
+		HttpOnly: true,
+		SameSite: s.options.SameSite,
+		MaxAge:   int(maxAge.Seconds()),
+	}
+	if maxAge < 0 {
+		cookie.MaxAge = -1
+	}
+	return cookie
+}
+
+// Read returns the request's session, if it has a valid one that hasn't expired.
+func (s *Sessions) Read(req *http.Request) (*Session, bool) {
+	var session Session
+	if !s.Open(req, s.options.CookieName, &session) {
+		return nil, false
+	}
+	if time.Now().Unix() >= session.Expires {
+		return nil, false
+	}
+	return &session, true
+}
+
+// Authenticate returns the identity of the request's session, renewing the session if it is due.
+// Sessions of users that were removed, or changed their password, are rejected.
+func (s *Sessions) Authenticate(w http.ResponseWriter, req *http.Request, users *Users) *Identity {
+	session, ok := s.Read(req)
+	if !ok {
+		return nil
+	}
+	user, ok := users.Get(session.Username)
+	if !ok || session.Fingerprint != fingerprint(user.PasswordHash) {
+		return nil
+	}
+
+	if time.Since(time.Unix(session.Issued, 0)) >= s.options.RotateAfter {
+		if err := s.Write(w, user); err != nil {
+			log.Error().Err(err).Str("user", user.Username).Msg("Error renewing session")
+		}
+	}
+	return &Identity{Name: user.Username, Roles: user.Roles, Method: "session"}
+}
+
+func fingerprint(passwordHash string) string {
+	sum := sha256.Sum256([]byte(passwordHash))
+	return hex.EncodeToString(sum[:8])
+}
+
+// SameOrigin reports whether a form post came from this host, going by the Origin header, or Sec-Fetch-Site
+// without one. Browsers send one of them on cross-site posts, so clients sending neither are allowed.
+func SameOrigin(req *http.Request) bool {
+	if origin := req.Header.Get("Origin"); origin != "" {
+		parsed, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(parsed.Host, req.Host)
+	}
+	switch req.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// How long a successful password check is remembered. Hashing is slow on purpose, and clients
+// using HTTP Basic auth send their password with every request.
+const verifiedTTL = time.Minute
+
+// User is an account in Aspen's user store.
+type User struct {
+	Username     string
+	PasswordHash string
+	Roles        []string
+}
+
+// Users is the user store of a config.
+type Users struct {
+	users map[string]User
+
+	// Remembers recent successful logins, keyed by a hash of the credentials and password hash
+	verified sync.Map
+}
+
+// A hash to verify against for unknown users, so they take as long to reject as wrong passwords
+var dummyHash, _ = HashPassword("not a real password")
+
+// NewUsers creates a user store, checking that usernames are unique and password hashes are supported.
+func NewUsers(users []User) (*Users, error) {
+	store := &Users{users: make(map[string]User)}
+	for _, user := range users {
+		if user.Username == "" {
+			return nil, fmt.Errorf("user has no username")
+		}
+		if _, ok := store.users[user.Username]; ok {
+			return nil, fmt.Errorf("user \"%s\" is defined more than once", user.Username)
+		}
+		if err := CheckPasswordHash(user.PasswordHash); err != nil {
+			return nil, fmt.Errorf("user \"%s\": %w", user.Username, err)
+		}
+		store.users[user.Username] = user
+	}
+	return store, nil
+}
+
+// Get returns a user by name.
+func (u *Users) Get(username string) (User, bool) {
+	if u == nil {
+		return User{}, false
+	}
+	user, ok := u.users[username]
+	return user, ok
+}
+
+// Authenticate checks a username and password, returning the user if they match.
+func (u *Users) Authenticate(username, password string) (User, bool) {
+	user, ok := u.Get(username)
+	if !ok {
+		VerifyPassword(dummyHash, password)
+		return User{}, false
+	}
+
+	key := sha256.Sum256([]byte(username + "\x00" + password + "\x00" + user.PasswordHash))
+	if expires, ok := u.verified.Load(key); ok && time.Now().Before(expires.(time.Time)) {
+		return user, true
+	}
+	if !VerifyPassword(user.PasswordHash, password) {
+		return User{}, false
+	}
+	u.verified.Store(key, time.Now().Add(verifiedTTL))
+	return user, true
+}
+
+// Identity is who a request was authenticated as, and the roles it has.
+type Identity struct {
+	Name  string
+	Roles []string
+	// How the request was authenticated, e.g. "basic"
+	Method string
+}
+
+// HasAnyRole reports whether the identity has at least one of the roles. Any identity passes an empty list.
+func (i *Identity) HasAnyRole(roles []string) bool {
+	if len(roles) == 0 {
+		return true
+	}
+	for _, role := range roles {
+		if slices.Contains(i.Roles, role) {
+			return true
+		}
+	}
+	return false
+}
@@ -37,14 +37,16 @@ func BenchmarkRouter(b *testing.B) {
 
 	// Set up router with paths
 	paths := GenerateRandomPaths(rng, 1000)
-	resources := make(map[string]router.Resource)
-	for _, path := range paths {
-		resources[path] = resource
+	routes := make([]router.Route, len(paths))
+	for i, path := range paths {
+		routes[i] = router.Route{Path: path, Resource: resource}
 	}
 	router.UpdateRouter(router.NewRouterInstance(
-		[]router.Middleware{},
+		router.DefaultOptions(),
+		[]router.MiddlewareFunc{},
 		[]*service.Service{},
-		resources,
+		map[string]*http.Transport{},
+		routes,
 	))
 
 	// Sample paths to get the requests we'll be benchmarking
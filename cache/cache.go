@@ -0,0 +1,356 @@
+package cache
+
+import (
+	"aspen/auth"
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultMaxBytes      = 64 * 1024 * 1024
+	defaultMaxEntryBytes = 8 * 1024 * 1024
+	defaultMaxDiskBytes  = 1024 * 1024 * 1024
+
+	// Background revalidations aren't tied to a client, so they get their own time limit
+	revalidateTimeout = 30 * time.Second
+)
+
+// Options configures a cache.
+type Options struct {
+	// Total size of entries kept in memory (default 64MiB). Larger responses (default 8MiB) aren't stored.
+	MaxBytes      int64
+	MaxEntryBytes int64
+
+	// Freshness of responses that have no Cache-Control max-age or Expires header.
+	// If zero, such responses are only stored if they can be revalidated.
+	DefaultTTL time.Duration
+
+	// Optional directory for a larger on-disk tier (default 1GiB). Each started cache uses its own subdirectory,
+	// which is removed when it stops. Subdirectories left by previous runs are cleared.
+	Dir          string
+	MaxDiskBytes int64
+}
+
+func (o Options) withDefaults() Options {
+	if o.MaxBytes <= 0 {
+		o.MaxBytes = defaultMaxBytes
+	}
+	if o.MaxEntryBytes <= 0 {
+		o.MaxEntryBytes = defaultMaxEntryBytes
+	}
+	if o.MaxDiskBytes <= 0 {
+		o.MaxDiskBytes = defaultMaxDiskBytes
+	}
+	return o
+}
+
+// Cache is a shared HTTP cache in front of a handler. It honors Cache-Control, Expires and Vary,
+// revalidates stale responses with ETag and Last-Modified, serves stale-while-revalidate responses
+// while revalidating in the background, and sends one request for concurrent misses of the same URL.
+type Cache struct {
+	options Options
+	store   *store
+
+	// Requests currently fetching a response, by key
+	flightLock sync.Mutex
+	flights    map[string]chan struct{}
+}
+
+// New creates a cache. Call Start before using it.
+func New(options Options) *Cache {
+	options = options.withDefaults()
+	return &Cache{
+		options: options,
+		store:   newStore(options.MaxBytes, options.Dir, options.MaxDiskBytes),
+		flights: make(map[string]chan struct{}),
+	}
+}
+
+// Start prepares the on-disk tier, if there is one. If that fails, the cache only uses memory.
+func (c *Cache) Start() {
+	if err := c.store.open(); err != nil {
+		log.Error().Err(err).Str("dir", c.options.Dir).Msg("Disabling on-disk cache")
+	}
+}
+
+// Stop removes the entries of the on-disk tier. The cache keeps working from memory.
+func (c *Cache) Stop() {
+	if err := c.store.close(); err != nil {
+		log.Error().Err(err).Str("dir", c.options.Dir).Msg("Error stopping on-disk cache")
+	}
+}
+
+// Purge removes every entry whose path starts with prefix, returning how many entries were removed.
+func (c *Cache) Purge(prefix string) int {
+	return c.store.purge(prefix)
+}
+
+// Serve responds to the request from the cache, using next to fetch responses that aren't cached or are stale.
+func (c *Cache) Serve(w http.ResponseWriter, req *http.Request, next http.Handler) {
+	if !c.cacheableRequest(req) {
+		next.ServeHTTP(w, req)
+
+		// Changing a resource makes stored copies of it outdated
+		if !isSafeMethod(req.Method) {
+			c.store.delete(c.key(req))
+		}
+		return
+	}
+
+	key := c.key(req)
+	now := time.Now()
+	revalidate := revalidationRequested(req)
+
+	cached := c.lookup(key, req)
+	if cached != nil && !revalidate {
+		if cached.fresh(now) {
+			c.serve(w, req, cached, "HIT")
+			return
+		}
+		if cached.stale(now) {
+			c.serve(w, req, cached, "STALE")
+			c.revalidateInBackground(key, req, cached, next)
+			return
+		}
+	}
+
+	// Concurrent misses wait for the first one, and use its response if it could be stored
+	done, leader := c.startFlight(key)
+	if !leader {
+		select {
+		case <-done:
+		case <-req.Context().Done():
+			return
+		}
+		if shared := c.lookup(key, req); shared != nil && shared.fresh(time.Now()) {
+			c.serve(w, req, shared, "HIT")
+			return
+		}
+		c.fetch(w, req, key, cached, next)
+		return
+	}
+	defer c.finishFlight(key)
+
+	c.fetch(w, req, key, cached, next)
+}
+
+// fetch gets a response from next and stores it if possible. If a stored entry is given,
+// the request is made conditional so an unchanged response doesn't have to be sent again.
+// With a nil ResponseWriter, the response is only stored.
+func (c *Cache) fetch(w http.ResponseWriter, req *http.Request, key string, cached *entry, next http.Handler) {
+	out := req
+	conditional := false
+	if cached != nil && cached.hasValidators() && !isConditional(req) {
+		out = req.Clone(req.Context())
+		if etag := cached.Header.Get("ETag"); etag != "" {
+			out.Header.Set("If-None-Match", etag)
+		}
+		if lastModified := cached.Header.Get("Last-Modified"); lastModified != "" {
+			out.Header.Set("If-Modified-Since", lastModified)
+		}
+		conditional = true
+	}
+
+	cw := newCaptureWriter(w, c.options.MaxEntryBytes, conditional)
+	next.ServeHTTP(cw, out)
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	now := time.Now()
+
+	if cw.held {
+		refreshed, ok := cached.refresh(cw.header, now, c.options.DefaultTTL)
+		if !ok {
+			c.store.delete(key)
+			refreshed = cached
+		} else {
+			c.storeEntry(key, req, refreshed)
+		}
+		if w != nil {
+			c.serve(w, req, refreshed, "REVALIDATED")
+		}
+		return
+	}
+
+	// Only complete responses to plain GETs are stored
+	if req.Method != http.MethodGet || cw.overflow || isConditional(req) || req.Context().Err() != nil {
+		return
+	}
+	if e, ok := newEntry(cw.status, cw.header, cw.body.Bytes(), now, c.options.DefaultTTL); ok {
+		c.storeEntry(key, req, e)
+	} else if cached != nil {
+		c.store.delete(key)
+	}
+}
+
+// revalidateInBackground refreshes a stale entry without holding up the client, unless a refresh is already running.
+func (c *Cache) revalidateInBackground(key string, req *http.Request, cached *entry, next http.Handler) {
+	_, leader := c.startFlight(key)
+	if !leader {
+		return
+	}
+
+	// The request outlives the client, so it keeps the request values but not its cancellation
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(req.Context()), revalidateTimeout)
+	background := req.Clone(ctx)
+	background.Header.Del("If-None-Match")
+	background.Header.Del("If-Modified-Since")
+	background.Method = http.MethodGet
+
+	go func() {
+		defer cancel()
+		defer c.finishFlight(key)
+		c.fetch(nil, background, key, cached, next)
+	}()
+}
+
+// lookup finds the entry for a request, following Vary to the variant matching the request.
+func (c *Cache) lookup(key string, req *http.Request) *entry {
+	e := c.store.get(key)
+	if e != nil && e.Marker {
+		e = c.store.get(variantKey(key, req, e.Vary))
+	}
+	return e
+}
+
+func (c *Cache) storeEntry(key string, req *http.Request, e *entry) {
+	if len(e.Vary) == 0 {
+		c.store.set(key, e)
+		return
+	}
+	c.store.set(key, &entry{Vary: e.Vary, Marker: true})
+	c.store.set(variantKey(key, req, e.Vary), e)
+}
+
+// serve writes a stored response, answering the client's own conditional requests.
+func (c *Cache) serve(w http.ResponseWriter, req *http.Request, e *entry, status string) {
+	header := w.Header()
+	copyHeader(header, e.Header)
+	header.Set("Age", strconv.Itoa(int(e.age(time.Now()).Seconds())))
+	header.Set("X-Cache", status)
+
+	if notModified(req, e) {
+		for _, key := range []string{"Content-Length", "Content-Type", "Content-Encoding", "Transfer-Encoding"} {
+			header.Del(key)
+		}
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	header.Del("Transfer-Encoding")
+	header.Set("Content-Length", strconv.Itoa(len(e.Body)))
+	w.WriteHeader(e.Status)
+	if req.Method != http.MethodHead {
+		w.Write(e.Body)
+	}
+}
+
+// key identifies the cached resource for a request. It starts with the path, so entries can be purged by path prefix.
+func (c *Cache) key(req *http.Request) string {
+	return req.URL.RequestURI() + "\x00" + req.Host
+}
+
+func variantKey(key string, req *http.Request, vary []string) string {
+	var b strings.Builder
+	b.WriteString(key)
+	for _, name := range vary {
+		b.WriteString("\x00")
+		b.WriteString(strings.Join(req.Header.Values(name), ","))
+	}
+	return b.String()
+}
+
+func (c *Cache) startFlight(key string) (chan struct{}, bool) {
+	c.flightLock.Lock()
+	defer c.flightLock.Unlock()
+
+	if done, ok := c.flights[key]; ok {
+		return done, false
+	}
+	done := make(chan struct{})
+	c.flights[key] = done
+	return done, true
+}
+
+func (c *Cache) finishFlight(key string) {
+	c.flightLock.Lock()
+	defer c.flightLock.Unlock()
+
+	close(c.flights[key])
+	delete(c.flights, key)
+}
+
+// cacheableRequest checks if the request can be answered from the cache.
+// Requests with credentials are passed through, since their responses are specific to the client.
+// Authentication middleware removes some credentials once it has checked them, so requests it
+// authenticated are recognised by their identity instead.
+func (c *Cache) cacheableRequest(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	if req.Header.Get("Authorization") != "" || req.Header.Get("Upgrade") != "" {
+		return false
+	}
+	if auth.RequestIdentity(req) != nil {
+		return false
+	}
+	_, noStore := cacheControl(req.Header)["no-store"]
+	return !noStore
+}
+
+// revalidationRequested checks if the client asked for a response that is validated with the origin.
+func revalidationRequested(req *http.Request) bool {
+	directives := cacheControl(req.Header)
+	if _, ok := directives["no-cache"]; ok {
+		return true
+	}
+	if maxAge, ok := seconds(directives["max-age"]); ok && maxAge == 0 {
+		return true
+	}
+	return req.Header.Get("Pragma") == "no-cache" && req.Header.Get("Cache-Control") == ""
+}
+
+func isConditional(req *http.Request) bool {
+	return req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != ""
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions || method == http.MethodTrace
+}
+
+// notModified checks the client's conditional headers against a stored response.
+func notModified(req *http.Request, e *entry) bool {
+	if e.Status != http.StatusOK {
+		return false
+	}
+
+	if match := req.Header.Get("If-None-Match"); match != "" {
+		etag := e.Header.Get("ETag")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range splitHeaderList([]string{match}) {
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	if since := req.Header.Get("If-Modified-Since"); since != "" {
+		sinceTime, err := http.ParseTime(since)
+		if err != nil {
+			return false
+		}
+		modified, err := http.ParseTime(e.Header.Get("Last-Modified"))
+		return err == nil && !modified.After(sinceTime)
+	}
+
+	return false
+}
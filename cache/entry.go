@@ -0,0 +1,196 @@
+package cache
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Statuses that may be stored. Other responses are always passed through.
+var cacheableStatus = []int{
+	http.StatusOK,
+	http.StatusNonAuthoritativeInfo,
+	http.StatusNoContent,
+	http.StatusMultipleChoices,
+	http.StatusMovedPermanently,
+	http.StatusPermanentRedirect,
+	http.StatusNotFound,
+	http.StatusMethodNotAllowed,
+	http.StatusGone,
+	http.StatusRequestURITooLong,
+	http.StatusNotImplemented,
+}
+
+// entry is a stored response. Fields are exported so entries can be written to disk.
+type entry struct {
+	Status int
+	Header http.Header
+	Body   []byte
+
+	// When the response was generated, adjusted for any Age it already had
+	Date time.Time
+	// How long the response is fresh for, and how long after that it may be served while revalidating
+	Fresh                time.Duration
+	StaleWhileRevalidate time.Duration
+
+	// Request headers the response varies on. Entries with Marker set have no response, and only
+	// record Vary so the variant for a request can be found.
+	Vary   []string
+	Marker bool
+}
+
+// size estimates the memory used by the entry.
+func (e *entry) size() int64 {
+	size := int64(len(e.Body)) + 64
+	for key, values := range e.Header {
+		for _, value := range values {
+			size += int64(len(key) + len(value))
+		}
+	}
+	return size
+}
+
+func (e *entry) age(now time.Time) time.Duration {
+	return max(now.Sub(e.Date), 0)
+}
+
+// fresh reports whether the entry can be served without revalidating.
+func (e *entry) fresh(now time.Time) bool {
+	return e.age(now) < e.Fresh
+}
+
+// stale reports whether the entry is past its freshness, but may still be served while it is revalidated.
+func (e *entry) stale(now time.Time) bool {
+	age := e.age(now)
+	return age >= e.Fresh && age < e.Fresh+e.StaleWhileRevalidate
+}
+
+func (e *entry) hasValidators() bool {
+	return e.Header.Get("ETag") != "" || e.Header.Get("Last-Modified") != ""
+}
+
+// cacheControl parses Cache-Control directives into a map; directives without a value map to "".
+func cacheControl(h http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range h.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name == "" {
+				continue
+			}
+			directives[strings.ToLower(name)] = strings.Trim(arg, `"`)
+		}
+	}
+	return directives
+}
+
+// seconds parses a directive value as a number of seconds.
+func seconds(value string) (time.Duration, bool) {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// newEntry builds an entry from a response, if a shared cache may store it.
+// Responses without explicit freshness are fresh for defaultTTL, or stored only for revalidation if they have validators.
+func newEntry(status int, header http.Header, body []byte, now time.Time, defaultTTL time.Duration) (*entry, bool) {
+	if !slices.Contains(cacheableStatus, status) {
+		return nil, false
+	}
+
+	// Cookies are specific to a client, so they must never be replayed to others
+	if header.Get("Set-Cookie") != "" {
+		return nil, false
+	}
+
+	directives := cacheControl(header)
+	if _, ok := directives["no-store"]; ok {
+		return nil, false
+	}
+	if _, ok := directives["private"]; ok {
+		return nil, false
+	}
+
+	var vary []string
+	for _, name := range splitHeaderList(header.Values("Vary")) {
+		if name == "*" {
+			return nil, false
+		}
+		vary = append(vary, http.CanonicalHeaderKey(name))
+	}
+
+	e := &entry{
+		Status: status,
+		Header: header.Clone(),
+		Body:   body,
+		Date:   now,
+		Vary:   vary,
+	}
+
+	// Responses that already spent time in other caches are that much older
+	if age, ok := seconds(header.Get("Age")); ok {
+		e.Date = now.Add(-age)
+	}
+	e.Header.Del("Age")
+
+	if sMaxAge, ok := seconds(directives["s-maxage"]); ok {
+		e.Fresh = sMaxAge
+	} else if maxAge, ok := seconds(directives["max-age"]); ok {
+		e.Fresh = maxAge
+	} else if expires := header.Get("Expires"); expires != "" {
+		// Invalid dates, like "0", mean the response has already expired
+		if expiresAt, err := http.ParseTime(expires); err == nil {
+			date := now
+			if d, err := http.ParseTime(header.Get("Date")); err == nil {
+				date = d
+			}
+			e.Fresh = max(expiresAt.Sub(date), 0)
+		}
+	} else if defaultTTL > 0 {
+		e.Fresh = defaultTTL
+	} else if !e.hasValidators() {
+		return nil, false
+	}
+
+	if _, ok := directives["no-cache"]; ok {
+		e.Fresh = 0
+	}
+
+	_, mustRevalidate := directives["must-revalidate"]
+	_, proxyRevalidate := directives["proxy-revalidate"]
+	if swr, ok := seconds(directives["stale-while-revalidate"]); ok && !mustRevalidate && !proxyRevalidate {
+		e.StaleWhileRevalidate = swr
+	}
+
+	return e, true
+}
+
+// refresh updates an entry with the headers of a 304 Not Modified response to its revalidation.
+func (e *entry) refresh(header http.Header, now time.Time, defaultTTL time.Duration) (*entry, bool) {
+	merged := e.Header.Clone()
+	for key, values := range header {
+		// These describe the body, which a 304 doesn't have
+		switch key {
+		case "Content-Length", "Content-Type", "Content-Encoding", "Transfer-Encoding":
+			continue
+		}
+		merged[key] = values
+	}
+	return newEntry(e.Status, merged, e.Body, now, defaultTTL)
+}
+
+func splitHeaderList(values []string) []string {
+	var items []string
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+	}
+	return items
+}
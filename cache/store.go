@@ -0,0 +1,277 @@
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// lru tracks items up to a total size, evicting the least recently used ones beyond it.
+type lru[V any] struct {
+	maxBytes int64
+	bytes    int64
+	order    *list.List
+	items    map[string]*list.Element
+	onEvict  func(key string)
+}
+
+type lruItem[V any] struct {
+	key   string
+	value V
+	size  int64
+}
+
+func newLRU[V any](maxBytes int64, onEvict func(key string)) *lru[V] {
+	return &lru[V]{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		items:    make(map[string]*list.Element),
+		onEvict:  onEvict,
+	}
+}
+
+func (l *lru[V]) get(key string) (V, bool) {
+	element, ok := l.items[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	l.order.MoveToFront(element)
+	return element.Value.(*lruItem[V]).value, true
+}
+
+func (l *lru[V]) set(key string, value V, size int64) {
+	l.remove(key)
+
+	l.items[key] = l.order.PushFront(&lruItem[V]{key: key, value: value, size: size})
+	l.bytes += size
+
+	for l.bytes > l.maxBytes && l.order.Len() > 0 {
+		oldest := l.order.Back().Value.(*lruItem[V])
+		l.remove(oldest.key)
+		if l.onEvict != nil {
+			l.onEvict(oldest.key)
+		}
+	}
+}
+
+func (l *lru[V]) remove(key string) bool {
+	element, ok := l.items[key]
+	if !ok {
+		return false
+	}
+	l.bytes -= element.Value.(*lruItem[V]).size
+	l.order.Remove(element)
+	delete(l.items, key)
+	return true
+}
+
+// store keeps entries in memory, and optionally on disk as a larger second tier.
+// Entries evicted from memory are still found on disk, and moved back into memory when used.
+type store struct {
+	lock   sync.Mutex
+	memory *lru[*entry]
+
+	// Each started store keeps its entries in its own directory under root, so a store being replaced
+	// doesn't lose the entries it is still serving. Only the keys and sizes of entries on disk are kept in memory.
+	root string
+	dir  string
+	disk *lru[struct{}]
+}
+
+// Directories of the stores that are open in this process, which mustn't be cleared as left over
+var openDirs sync.Map
+
+func newStore(maxBytes int64, dir string, maxDiskBytes int64) *store {
+	s := &store{memory: newLRU[*entry](maxBytes, nil)}
+	if dir != "" {
+		// Cleaned to match the paths of leftover directories
+		s.root = filepath.Clean(dir)
+		s.disk = newLRU[struct{}](maxDiskBytes, func(key string) {
+			os.Remove(s.path(key))
+		})
+	}
+	return s
+}
+
+// open creates the store's directory for entries on disk, and clears directories left by previous runs,
+// since their entries aren't tracked. If that fails, the store only uses memory.
+func (s *store) open() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.disk == nil {
+		return nil
+	}
+
+	if err := s.openNoLock(); err != nil {
+		s.disk = nil
+		return err
+	}
+	return nil
+}
+
+func (s *store) openNoLock() error {
+	if err := os.MkdirAll(s.root, 0o755); err != nil {
+		return fmt.Errorf("error creating cache directory: %w", err)
+	}
+	leftovers, err := filepath.Glob(filepath.Join(s.root, "instance-*"))
+	if err != nil {
+		return err
+	}
+	for _, dir := range leftovers {
+		if _, ok := openDirs.Load(dir); !ok {
+			if err := os.RemoveAll(dir); err != nil {
+				return fmt.Errorf("error clearing old cache directory: %w", err)
+			}
+		}
+	}
+
+	dir, err := os.MkdirTemp(s.root, "instance-")
+	if err != nil {
+		return fmt.Errorf("error creating cache directory: %w", err)
+	}
+	s.dir = dir
+	openDirs.Store(dir, true)
+	return nil
+}
+
+// close removes the store's directory, leaving it with only its memory tier.
+func (s *store) close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.disk == nil {
+		return nil
+	}
+
+	s.disk = nil
+	defer openDirs.Delete(s.dir)
+	if err := os.RemoveAll(s.dir); err != nil {
+		return fmt.Errorf("error removing cache directory: %w", err)
+	}
+	return nil
+}
+
+func (s *store) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:]))
+}
+
+func (s *store) get(key string) *entry {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if e, ok := s.memory.get(key); ok {
+		return e
+	}
+	if s.disk == nil {
+		return nil
+	}
+	if _, ok := s.disk.get(key); !ok {
+		return nil
+	}
+
+	e, err := s.readDisk(key)
+	if err != nil {
+		log.Warn().Err(err).Str("key", key).Msg("Error reading cache entry from disk")
+		s.disk.remove(key)
+		os.Remove(s.path(key))
+		return nil
+	}
+	s.memory.set(key, e, e.size())
+	return e
+}
+
+func (s *store) set(key string, e *entry) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.memory.set(key, e, e.size())
+	if s.disk == nil {
+		return
+	}
+
+	if err := s.writeDisk(key, e); err != nil {
+		log.Warn().Err(err).Str("key", key).Msg("Error writing cache entry to disk")
+		s.disk.remove(key)
+		return
+	}
+	s.disk.set(key, struct{}{}, e.size())
+}
+
+func (s *store) delete(key string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.deleteNoLock(key)
+}
+
+func (s *store) deleteNoLock(key string) {
+	s.memory.remove(key)
+	if s.disk != nil && s.disk.remove(key) {
+		os.Remove(s.path(key))
+	}
+}
+
+// purge deletes every entry whose key starts with prefix, returning how many were deleted.
+func (s *store) purge(prefix string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	keys := make(map[string]bool)
+	for key := range s.memory.items {
+		keys[key] = true
+	}
+	if s.disk != nil {
+		for key := range s.disk.items {
+			keys[key] = true
+		}
+	}
+
+	purged := 0
+	for key := range keys {
+		if strings.HasPrefix(key, prefix) {
+			s.deleteNoLock(key)
+			purged++
+		}
+	}
+	return purged
+}
+
+func (s *store) readDisk(key string) (*entry, error) {
+	file, err := os.Open(s.path(key))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var e entry
+	if err := gob.NewDecoder(file).Decode(&e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// writeDisk writes to a temporary file first, so readers never see a partial entry.
+func (s *store) writeDisk(key string, e *entry) error {
+	file, err := os.CreateTemp(s.dir, "tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if err := gob.NewEncoder(file).Encode(e); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), s.path(key))
+}
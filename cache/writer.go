@@ -0,0 +1,101 @@
+package cache
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// captureWriter records a response while passing it through to the client, if there is one.
+// A 304 answering a revalidation that the cache added is held back, since the client didn't ask for it.
+type captureWriter struct {
+	w      http.ResponseWriter
+	header http.Header
+
+	status      int
+	wroteHeader bool
+	held        bool
+	conditional bool
+
+	// The body is only kept while it fits in the entry size limit
+	body     bytes.Buffer
+	limit    int64
+	overflow bool
+}
+
+func newCaptureWriter(w http.ResponseWriter, limit int64, conditional bool) *captureWriter {
+	return &captureWriter{
+		w:           w,
+		header:      make(http.Header),
+		limit:       limit,
+		conditional: conditional,
+	}
+}
+
+func (cw *captureWriter) Header() http.Header {
+	return cw.header
+}
+
+func (cw *captureWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+
+	// Informational responses, like 103 Early Hints, are passed on without ending the response
+	if status >= 100 && status < 200 {
+		if cw.w != nil {
+			copyHeader(cw.w.Header(), cw.header)
+			cw.w.WriteHeader(status)
+		}
+		return
+	}
+
+	cw.status = status
+	cw.wroteHeader = true
+
+	if cw.conditional && status == http.StatusNotModified {
+		cw.held = true
+		return
+	}
+	if cw.w != nil {
+		copyHeader(cw.w.Header(), cw.header)
+		cw.w.WriteHeader(status)
+	}
+}
+
+func (cw *captureWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if !cw.overflow {
+		if int64(cw.body.Len()+len(b)) > cw.limit {
+			cw.overflow = true
+			cw.body = bytes.Buffer{}
+		} else {
+			cw.body.Write(b)
+		}
+	}
+
+	if cw.w == nil || cw.held {
+		return len(b), nil
+	}
+	return cw.w.Write(b)
+}
+
+// Flush passes flushes through, so streamed responses still arrive as they are written.
+func (cw *captureWriter) Flush() {
+	if cw.w != nil && !cw.held {
+		http.NewResponseController(cw.w).Flush()
+	}
+}
+
+func (cw *captureWriter) Unwrap() http.ResponseWriter {
+	return cw.w
+}
+
+// copyHeader replaces the headers in dst with those in src.
+func copyHeader(dst, src http.Header) {
+	for key, values := range src {
+		dst[key] = values
+	}
+}
@@ -0,0 +1,175 @@
+package config
+
+import (
+	"aspen/auth"
+	"aspen/router"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// How often the last use of API keys is written to the key use file
+const apiKeyUseInterval = time.Minute
+
+// Serialises writes to the key use file, which instances being replaced and their successors share
+var apiKeyUseLock sync.Mutex
+
+type APIKeyConfig struct {
+	// Public part of the key, which is shown in listings
+	ID   string
+	Name string
+	// SHA-256 of the key's secret. The secret itself is only shown when the key is minted.
+	Hash    string
+	Roles   []string
+	Created time.Time
+	// Keys without an expiry last until they are revoked
+	Expires *time.Time `json:",omitempty"`
+}
+
+func (kc APIKeyConfig) Parse() auth.APIKey {
+	key := auth.APIKey{
+		ID:    kc.ID,
+		Name:  kc.Name,
+		Hash:  kc.Hash,
+		Roles: kc.Roles,
+	}
+	if kc.Expires != nil {
+		key.Expires = *kc.Expires
+	}
+	return key
+}
+
+// GetAPIKeys creates the API key store, checking the key IDs and hashes.
+func (c *Config) GetAPIKeys() (*auth.APIKeys, error) {
+	var keys = make([]auth.APIKey, len(c.APIKeys))
+	for i, keyConfig := range c.APIKeys {
+		keys[i] = keyConfig.Parse()
+	}
+
+	return auth.NewAPIKeys(keys)
+}
+
+// recordAPIKeyUse writes when the instance's API keys were used to the key use file, every apiKeyUseInterval
+// while the instance is active, and once more when it stops.
+func recordAPIKeyUse(instance *router.RouterInstance, keys *auth.APIKeys) {
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+
+	instance.OnStart(func() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ticker := time.NewTicker(apiKeyUseInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					writeAPIKeyUse(keys.TakeUsed())
+				case <-stop:
+					writeAPIKeyUse(keys.TakeUsed())
+					return
+				}
+			}
+		}()
+	})
+	instance.OnStop(func() {
+		close(stop)
+		wg.Wait()
+	})
+}
+
+// apiKeyUseFile is where the last use of API keys is kept, next to the global config file. It is state rather
+// than config, so writing it doesn't touch the config or need a reload.
+func apiKeyUseFile() string {
+	return globalConfigFile + ".api_key_use.json"
+}
+
+// ReadAPIKeyUse returns when each API key was last used, as recorded in the key use file.
+func ReadAPIKeyUse() (map[string]time.Time, error) {
+	apiKeyUseLock.Lock()
+	defer apiKeyUseLock.Unlock()
+	return readAPIKeyUseNoLock()
+}
+
+func readAPIKeyUseNoLock() (map[string]time.Time, error) {
+	used := make(map[string]time.Time)
+	if globalConfigFile == "" {
+		return used, nil
+	}
+	data, err := os.ReadFile(apiKeyUseFile())
+	if errors.Is(err, fs.ErrNotExist) {
+		return used, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading API key use file: %w", err)
+	}
+	if err := json.Unmarshal(data, &used); err != nil {
+		return nil, fmt.Errorf("error parsing API key use file: %w", err)
+	}
+	return used, nil
+}
+
+// writeAPIKeyUse merges uses into the key use file, dropping keys that are no longer in the config.
+func writeAPIKeyUse(used map[string]time.Time) {
+	if len(used) == 0 || globalConfigFile == "" {
+		return
+	}
+
+	apiKeyUseLock.Lock()
+	defer apiKeyUseLock.Unlock()
+
+	recorded, err := readAPIKeyUseNoLock()
+	if err != nil {
+		log.Warn().Err(err).Msg("Replacing unreadable API key use file")
+		recorded = make(map[string]time.Time)
+	}
+	for id, lastUsed := range used {
+		if lastUsed.After(recorded[id]) {
+			recorded[id] = lastUsed
+		}
+	}
+	if c, err := ReadGlobalConfig(); err == nil {
+		configured := make(map[string]bool, len(c.APIKeys))
+		for _, key := range c.APIKeys {
+			configured[key.ID] = true
+		}
+		for id := range recorded {
+			if !configured[id] {
+				delete(recorded, id)
+			}
+		}
+	}
+
+	if err := writeFileAtomic(apiKeyUseFile(), recorded); err != nil {
+		log.Error().Err(err).Msg("Error recording API key use")
+	}
+}
+
+// writeFileAtomic writes a value as JSON through a temporary file, so readers never see a partial file.
+func writeFileAtomic(name string, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), name)
+}
@@ -1,9 +1,11 @@
 package config
 
 import (
+	"aspen/auth"
 	"aspen/router"
 	"aspen/router/service"
 	"fmt"
+	"net/http"
 )
 
 type Config struct {
@@ -11,32 +13,49 @@ type Config struct {
 	Middleware  []MiddlewareConfig
 	Routes      []RouteConfig
 	Services    []ServiceConfig
+	Transports  []TransportConfig
+	ErrorPages  *ErrorPagesConfig
+	Router      RouterConfig
+	Users       []UserConfig
+	Sessions    SessionConfig
+	APIKeys     []APIKeyConfig
 }
 
-func (c *Config) GetMiddleware() ([]router.Middleware, error) {
-	var middlewares = make([]router.Middleware, len(c.Middleware))
-	for i, middleware := range c.Middleware {
-		mw, err := middleware.Parse()
-		if err != nil {
-			return nil, fmt.Errorf("unable to parse middleware: %w", err)
-		}
-		middlewares[i] = mw
-	}
-
-	return middlewares, nil
+// GetMiddleware parses the global middleware chain, which runs on every route.
+func (c *Config) GetMiddleware() ([]router.MiddlewareFunc, error) {
+	return parseMiddleware(c.Middleware)
 }
 
-func (c *Config) GetResourceRoutes() (map[string]router.Resource, error) {
-	var resource_routes = make(map[string]router.Resource)
+// GetResourceRoutes parses the resource of every route. Routes that fail to parse are added to the report.
+func (c *Config) GetResourceRoutes(report *router.ValidationReport) []router.Route {
+	var resource_routes = make([]router.Route, 0, len(c.Routes))
 	for _, route := range c.Routes {
 		resource, err := route.Parse()
 		if err != nil {
-			return nil, fmt.Errorf("unable to parse route: %w", err)
+			report.Add(route.Id, "Resource", "%v", err)
+			continue
+		}
+		middleware, err := parseMiddleware(route.Middleware)
+		if err != nil {
+			report.Add(route.Id, "Middleware", "%v", err)
+			continue
 		}
-		resource_routes[route.Route] = resource
+		errorPages, err := route.ErrorPages.Parse()
+		if err != nil {
+			report.Add(route.Id, "ErrorPages", "%v", err)
+			continue
+		}
+		resource_routes = append(resource_routes, router.Route{
+			Host:               route.Host,
+			Path:               route.Route,
+			Resource:           resource,
+			Middleware:         middleware,
+			OverrideMiddleware: route.OverrideMiddleware,
+			ErrorPages:         errorPages,
+		})
 	}
 
-	return resource_routes, nil
+	return resource_routes
 }
 
 func (c *Config) GetServices() ([]*service.Service, error) {
@@ -52,25 +71,103 @@ func (c *Config) GetServices() ([]*service.Service, error) {
 	return services, nil
 }
 
+func (c *Config) GetTransports() (map[string]*http.Transport, error) {
+	var transports = make(map[string]*http.Transport)
+	for _, transportConfig := range c.Transports {
+		if _, ok := transports[transportConfig.Name]; ok {
+			return nil, fmt.Errorf("transport \"%s\" is defined more than once", transportConfig.Name)
+		}
+		transport, err := transportConfig.Parse()
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse transport \"%s\": %w", transportConfig.Name, err)
+		}
+		transports[transportConfig.Name] = transport
+	}
+
+	return transports, nil
+}
+
+// GetUsers creates the user store, checking usernames and password hashes.
+func (c *Config) GetUsers() (*auth.Users, error) {
+	var users = make([]auth.User, len(c.Users))
+	for i, userConfig := range c.Users {
+		users[i] = userConfig.Parse()
+	}
+
+	return auth.NewUsers(users)
+}
+
+// ToRouterInstance builds a router instance from the config. Every problem found is collected into
+// a *router.ValidationReport, which is returned as the error instead of an instance that is missing routes.
 func (c *Config) ToRouterInstance() (*router.RouterInstance, error) {
+	var report router.ValidationReport
+
 	middleware, err := c.GetMiddleware()
 	if err != nil {
-		return nil, fmt.Errorf("error loading middleware: %w", err)
+		report.Add("", "Middleware", "%v", err)
+	}
+
+	services, err := c.GetServices()
+	if err != nil {
+		report.Add("", "Services", "%v", err)
 	}
 
-	resource_routes, err := c.GetResourceRoutes()
+	transports, err := c.GetTransports()
 	if err != nil {
-		return nil, fmt.Errorf("error loading routes: %w", err)
+		report.Add("", "Transports", "%v", err)
 	}
 
-	services, err := c.GetServices()
+	errorPages, err := c.ErrorPages.Parse()
 	if err != nil {
-		return nil, fmt.Errorf("error loading services: %w", err)
+		report.Add("", "ErrorPages", "%v", err)
 	}
 
-	return router.NewRouterInstance(
+	users, err := c.GetUsers()
+	if err != nil {
+		report.Add("", "Users", "%v", err)
+	}
+
+	sessions, err := c.Sessions.Parse()
+	if err != nil {
+		report.Add("", "Sessions", "%v", err)
+	}
+
+	apiKeys, err := c.GetAPIKeys()
+	if err != nil {
+		report.Add("", "APIKeys", "%v", err)
+	}
+
+	// Problems with the routes themselves make their handlers meaningless, so check them before parsing
+	c.validateRoutes(&report)
+	if err := report.Err(); err != nil {
+		return nil, err
+	}
+
+	resource_routes := c.GetResourceRoutes(&report)
+	if err := report.Err(); err != nil {
+		return nil, err
+	}
+
+	options := c.Router.Parse()
+	options.ErrorPages = errorPages
+	options.Users = users
+	options.Sessions = sessions
+	options.APIKeys = apiKeys
+	instance := router.NewRouterInstance(
+		options,
 		middleware,
 		services,
+		transports,
 		resource_routes,
-	), nil
+	)
+	report.Issues = append(report.Issues, instance.Issues()...)
+	if err := report.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(c.APIKeys) > 0 {
+		recordAPIKeyUse(instance, apiKeys)
+	}
+
+	return instance, nil
 }
@@ -0,0 +1,91 @@
+package config
+
+import (
+	"aspen/router"
+	"fmt"
+	htmltemplate "html/template"
+	"os"
+	"text/template"
+)
+
+// ErrorTemplatesConfig names the template files used to render errors.
+type ErrorTemplatesConfig struct {
+	// html/template file, for clients accepting HTML
+	HTML string `json:",omitempty"`
+	// text/template file producing JSON, for clients asking for JSON. Has a "json" function to encode values.
+	JSON string `json:",omitempty"`
+}
+
+// ErrorPagesConfig sets the templates for every error, with overrides for a status code ("404") or class ("5xx").
+type ErrorPagesConfig struct {
+	ErrorTemplatesConfig
+	Statuses map[string]ErrorTemplatesConfig `json:",omitempty"`
+}
+
+func (tc ErrorTemplatesConfig) Parse() (router.ErrorTemplates, error) {
+	var templates router.ErrorTemplates
+
+	if tc.HTML != "" {
+		data, err := os.ReadFile(tc.HTML)
+		if err != nil {
+			return templates, fmt.Errorf("error reading HTML template: %w", err)
+		}
+		templates.HTML, err = htmltemplate.New(tc.HTML).Parse(string(data))
+		if err != nil {
+			return templates, fmt.Errorf("error parsing HTML template: %w", err)
+		}
+	}
+
+	if tc.JSON != "" {
+		data, err := os.ReadFile(tc.JSON)
+		if err != nil {
+			return templates, fmt.Errorf("error reading JSON template: %w", err)
+		}
+		templates.JSON, err = template.New(tc.JSON).Funcs(router.ErrorTemplateFuncs).Parse(string(data))
+		if err != nil {
+			return templates, fmt.Errorf("error parsing JSON template: %w", err)
+		}
+	}
+
+	return templates, nil
+}
+
+// Parse loads the error page templates. A nil config has no error pages.
+func (pc *ErrorPagesConfig) Parse() (*router.ErrorPages, error) {
+	if pc == nil {
+		return nil, nil
+	}
+
+	defaults, err := pc.ErrorTemplatesConfig.Parse()
+	if err != nil {
+		return nil, err
+	}
+	pages := &router.ErrorPages{
+		Default:  defaults,
+		Statuses: make(map[string]router.ErrorTemplates),
+	}
+
+	for status, templatesConfig := range pc.Statuses {
+		if !validErrorStatus(status) {
+			return nil, fmt.Errorf("invalid status '%s', expected a code like '404' or a class like '5xx'", status)
+		}
+		templates, err := templatesConfig.Parse()
+		if err != nil {
+			return nil, fmt.Errorf("error loading %s templates: %w", status, err)
+		}
+		pages.Statuses[status] = templates
+	}
+
+	return pages, nil
+}
+
+// validErrorStatus checks for an error status code like "404", or a class like "5xx".
+func validErrorStatus(status string) bool {
+	if len(status) != 3 || status[0] < '4' || status[0] > '5' {
+		return false
+	}
+	if status[1:] == "xx" {
+		return true
+	}
+	return status[1] >= '0' && status[1] <= '9' && status[2] >= '0' && status[2] <= '9'
+}
@@ -86,8 +86,7 @@ func UpdateGlobalConfig(updater func(config *Config) error) error {
 	}
 
 	// Verify that the new config is valid
-	_, err = config.ToRouterInstance()
-	if err != nil {
+	if err := config.Validate(); err != nil {
 		return fmt.Errorf("new config is not valid: %w", err)
 	}
 
@@ -2,23 +2,84 @@ package config
 
 import (
 	"aspen/router"
+	"encoding/json"
 	"fmt"
+
+	"github.com/rs/zerolog/log"
 )
 
-type MiddlewareConfig string
+// MiddlewareConfig selects a middleware type and its parameters.
+// A plain string like "logger" is accepted as a middleware without parameters.
+type MiddlewareConfig struct {
+	Type   string
+	Params map[string]any `json:",omitempty"`
+}
 
-var globalMiddlewareMap = make(map[string]router.Middleware)
+func (m *MiddlewareConfig) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*m = MiddlewareConfig{Type: name}
+		return nil
+	}
 
-func RegisterMiddleware(name string, middleware router.Middleware) error {
+	// Decode through another type, so this method isn't called again
+	type middlewareConfig MiddlewareConfig
+	var config middlewareConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return err
+	}
+	*m = MiddlewareConfig(config)
+	return nil
+}
+
+// Middleware define arbitrary parameters, like resources.
+type MiddlewareParams = any
+type MiddlewareConstructor[P MiddlewareParams] = func(P) (router.MiddlewareFunc, error)
+
+// A parser takes []byte JSON data and parses it using the relevant constructor into a middleware instance.
+type MiddlewareParser = func([]byte) (router.MiddlewareFunc, error)
+
+var globalMiddlewareMap = make(map[string]MiddlewareParser)
+var globalMiddlewareParamsMap = make(map[string]MiddlewareParams)
+
+func RegisterMiddlewareConstructor[P MiddlewareParams](middlewareType string, constructor MiddlewareConstructor[P]) error {
 	// Check if this type alrady exists
-	if _, ok := globalMiddlewareMap[name]; ok {
-		return fmt.Errorf("\"%s\" resource constructor has already been registered", name)
+	if _, ok := globalMiddlewareMap[middlewareType]; ok {
+		return fmt.Errorf("\"%s\" middleware constructor has already been registered", middlewareType)
+	}
+
+	// Save the parameters type for this middleware
+	var params P
+	globalMiddlewareParamsMap[middlewareType] = params
+
+	// Create parser function
+	parser := func(rawJson []byte) (router.MiddlewareFunc, error) {
+		var params P
+		err := json.Unmarshal(rawJson, &params)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing \"%s\" params: %w", middlewareType, err)
+		}
+
+		return constructor(params)
 	}
 
-	globalMiddlewareMap[name] = middleware
+	log.Debug().Str("middleware", middlewareType).Msg("Registered middleware constructor")
+	globalMiddlewareMap[middlewareType] = parser
 	return nil
 }
 
+// RegisterMiddleware registers a Middleware that takes no parameters.
+func RegisterMiddleware(name string, middleware router.Middleware) error {
+	return RegisterMiddlewareFunc(name, router.AdaptMiddleware(middleware))
+}
+
+// RegisterMiddlewareFunc registers a MiddlewareFunc that takes no parameters.
+func RegisterMiddlewareFunc(name string, middleware router.MiddlewareFunc) error {
+	return RegisterMiddlewareConstructor(name, func(struct{}) (router.MiddlewareFunc, error) {
+		return middleware, nil
+	})
+}
+
 // AvailableMiddleware returns a list of all registered middleware names.
 func AvailableMiddleware() []string {
 	var names = make([]string, 0, len(globalMiddlewareMap))
@@ -28,10 +89,43 @@ func AvailableMiddleware() []string {
 	return names
 }
 
-func (m MiddlewareConfig) Parse() (router.Middleware, error) {
-	middleware, ok := globalMiddlewareMap[string(m)]
+// GetMiddlewareParams retrieves the parameters type for a given middleware type.
+func GetMiddlewareParams(middlewareType string) (MiddlewareParams, error) {
+	params, ok := globalMiddlewareParamsMap[middlewareType]
+	if !ok {
+		return nil, fmt.Errorf("unable to find \"%s\" middleware parameters", middlewareType)
+	}
+	return params, nil
+}
+
+func (m MiddlewareConfig) Parse() (router.MiddlewareFunc, error) {
+	parser, ok := globalMiddlewareMap[m.Type]
 	if !ok {
-		return nil, fmt.Errorf("unable to find \"%s\" middleware", m)
+		return nil, fmt.Errorf("unable to find \"%s\" middleware", m.Type)
+	}
+
+	// Try parsing
+	rawParams, err := json.Marshal(m.Params)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read \"%s\" parameters", m.Type)
+	}
+	middleware, err := parser(rawParams)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create \"%s\" middleware: %w", m.Type, err)
 	}
 	return middleware, nil
 }
+
+// parseMiddleware parses a list of middleware, in order.
+func parseMiddleware(configs []MiddlewareConfig) ([]router.MiddlewareFunc, error) {
+	var middlewares = make([]router.MiddlewareFunc, len(configs))
+	for i, middleware := range configs {
+		mw, err := middleware.Parse()
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse middleware: %w", err)
+		}
+		middlewares[i] = mw
+	}
+
+	return middlewares, nil
+}
@@ -6,12 +6,23 @@ import (
 )
 
 type RouteConfig struct {
-	Id       string
-	Route    string
+	Id    string
+	Route string
+	// Optional host the route is served on: exact, or "*.example.com" for any subdomain
+	Host     string `json:",omitempty"`
 	Resource ResourceConfig
+	// Middleware run on this route after the global middleware, or instead of it with OverrideMiddleware
+	Middleware         []MiddlewareConfig `json:",omitempty"`
+	OverrideMiddleware bool               `json:",omitempty"`
+	// Error pages for this route, overriding the global ones
+	ErrorPages *ErrorPagesConfig `json:",omitempty"`
 }
 
 func (rc RouteConfig) Parse() (router.Resource, error) {
+	if err := router.ValidateHost(rc.Host); err != nil {
+		return nil, fmt.Errorf("error parsing \"%s\" route: %w", rc.Id, err)
+	}
+
 	// Create base resource
 	base := router.NewBaseResource(rc.Id)
 
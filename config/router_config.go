@@ -0,0 +1,44 @@
+package config
+
+import (
+	"aspen/router"
+	"aspen/utils"
+)
+
+// RouterConfig sets how requests that don't match a route are handled.
+// The policies default to true when unset, like in httprouter.
+type RouterConfig struct {
+	// ID of a route that only handles requests no other route matches, like an SPA fallback or a catch-all proxy
+	NotFound string `json:",omitempty"`
+
+	// Respond 405 with an Allow header when a path matches, but not the method
+	HandleMethodNotAllowed *bool `json:",omitempty"`
+	// Redirect /foo/ to /foo (or the reverse) when only the other one has a route
+	RedirectTrailingSlash *bool `json:",omitempty"`
+	// Redirect paths with the wrong case or extra elements like /../ to the cleaned path, if it has a route
+	RedirectFixedPath *bool `json:",omitempty"`
+	// Answer OPTIONS requests with the allowed methods of the path
+	HandleOPTIONS *bool `json:",omitempty"`
+
+	// How long a replaced config may finish its requests before its services are stopped. Defaults to 30s.
+	DrainTimeout utils.Duration `json:",omitempty"`
+}
+
+func (rc RouterConfig) Parse() router.Options {
+	options := router.DefaultOptions()
+	options.NotFound = rc.NotFound
+	setIfPresent(&options.HandleMethodNotAllowed, rc.HandleMethodNotAllowed)
+	setIfPresent(&options.RedirectTrailingSlash, rc.RedirectTrailingSlash)
+	setIfPresent(&options.RedirectFixedPath, rc.RedirectFixedPath)
+	setIfPresent(&options.HandleOPTIONS, rc.HandleOPTIONS)
+	if rc.DrainTimeout > 0 {
+		options.DrainTimeout = rc.DrainTimeout.Std()
+	}
+	return options
+}
+
+func setIfPresent(option *bool, value *bool) {
+	if value != nil {
+		*option = *value
+	}
+}
@@ -6,8 +6,10 @@ type ServiceConfig struct {
 	Id         string
 	Remote     string
 	CommitHash string
+	// Optional host port the service listens on, instead of looking up its published ports
+	Port int
 }
 
 func (sc ServiceConfig) Parse() (*service.Service, error) {
-	return service.NewService(sc.Id, sc.Remote, sc.CommitHash), nil
+	return service.NewService(sc.Id, sc.Remote, sc.CommitHash, sc.Port), nil
 }
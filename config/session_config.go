@@ -0,0 +1,54 @@
+package config
+
+import (
+	"aspen/auth"
+	"aspen/utils"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// SessionConfig sets how session cookies of the login resource are issued.
+type SessionConfig struct {
+	// Encrypts and signs the cookies. Without one, a random key is used and sessions end when Aspen restarts.
+	Secret string `json:",omitempty"`
+	// Defaults to "aspen_session"
+	CookieName string `json:",omitempty"`
+	Domain     string `json:",omitempty"`
+	// How long a session lasts without being renewed. Defaults to 12h.
+	MaxAge utils.Duration `json:",omitempty"`
+	// Sessions are renewed on their first request after this long. Defaults to 15m.
+	RotateAfter utils.Duration `json:",omitempty"`
+	// Only send the cookie over HTTPS. Defaults to true.
+	Secure *bool `json:",omitempty"`
+	// "Lax" (the default), "Strict" or "None"
+	SameSite string `json:",omitempty"`
+}
+
+func (sc SessionConfig) Parse() (*auth.Sessions, error) {
+	options := auth.DefaultSessionOptions()
+	if sc.CookieName != "" {
+		options.CookieName = sc.CookieName
+	}
+	options.Domain = sc.Domain
+	if sc.MaxAge > 0 {
+		options.MaxAge = sc.MaxAge.Std()
+	}
+	if sc.RotateAfter > 0 {
+		options.RotateAfter = sc.RotateAfter.Std()
+	}
+	setIfPresent(&options.Secure, sc.Secure)
+
+	switch strings.ToLower(sc.SameSite) {
+	case "", "lax":
+		options.SameSite = http.SameSiteLaxMode
+	case "strict":
+		options.SameSite = http.SameSiteStrictMode
+	case "none":
+		options.SameSite = http.SameSiteNoneMode
+	default:
+		return nil, fmt.Errorf("unknown SameSite mode \"%s\"", sc.SameSite)
+	}
+
+	return auth.NewSessions(sc.Secret, options)
+}
@@ -0,0 +1,81 @@
+package config
+
+import (
+	"aspen/proxy"
+	"aspen/utils"
+	"fmt"
+	"net/http"
+)
+
+// TransportConfig is a named profile for upstream connections, shared by every proxy that references it.
+type TransportConfig struct {
+	Name string
+
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     utils.Duration
+
+	DialTimeout           utils.Duration
+	TLSHandshakeTimeout   utils.Duration
+	ResponseHeaderTimeout utils.Duration
+
+	DisableHTTP2 bool
+	// Speak only HTTP/2 to upstreams, including cleartext h2c for http:// upstreams
+	H2C bool
+	TLS TLSConfig
+}
+
+// TLSConfig configures connections to HTTPS upstreams.
+type TLSConfig struct {
+	CAFile     string
+	CertFile   string
+	KeyFile    string
+	ServerName string
+	// "1.2" (default) or "1.3". Older versions are rejected.
+	MinVersion string
+	Insecure   bool
+}
+
+func (tc TransportConfig) Parse() (*http.Transport, error) {
+	if tc.Name == "" {
+		return nil, fmt.Errorf("transports must have a name")
+	}
+
+	tlsOptions, err := tc.TLS.Parse()
+	if err != nil {
+		return nil, err
+	}
+
+	return proxy.NewTransport(proxy.TransportOptions{
+		MaxIdleConns:          tc.MaxIdleConns,
+		MaxIdleConnsPerHost:   tc.MaxIdleConnsPerHost,
+		IdleConnTimeout:       tc.IdleConnTimeout.Std(),
+		DialTimeout:           tc.DialTimeout.Std(),
+		TLSHandshakeTimeout:   tc.TLSHandshakeTimeout.Std(),
+		ResponseHeaderTimeout: tc.ResponseHeaderTimeout.Std(),
+		DisableHTTP2:          tc.DisableHTTP2,
+		H2C:                   tc.H2C,
+		TLS:                   tlsOptions,
+	})
+}
+
+// IsSet reports whether any TLS setting is given.
+func (tc TLSConfig) IsSet() bool {
+	return tc != TLSConfig{}
+}
+
+func (tc TLSConfig) Parse() (proxy.TLSOptions, error) {
+	minVersion, err := proxy.ParseTLSVersion(tc.MinVersion)
+	if err != nil {
+		return proxy.TLSOptions{}, err
+	}
+
+	return proxy.TLSOptions{
+		CAFile:     tc.CAFile,
+		CertFile:   tc.CertFile,
+		KeyFile:    tc.KeyFile,
+		ServerName: tc.ServerName,
+		MinVersion: minVersion,
+		Insecure:   tc.Insecure,
+	}, nil
+}
@@ -0,0 +1,18 @@
+package config
+
+import "aspen/auth"
+
+type UserConfig struct {
+	Username string
+	// argon2id or bcrypt hash of the password, e.g. from "aspen -hash-password"
+	PasswordHash string
+	Roles        []string
+}
+
+func (uc UserConfig) Parse() auth.User {
+	return auth.User{
+		Username:     uc.Username,
+		PasswordHash: uc.PasswordHash,
+		Roles:        uc.Roles,
+	}
+}
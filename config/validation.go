@@ -0,0 +1,41 @@
+package config
+
+import (
+	"aspen/router"
+	"strings"
+)
+
+// validateRoutes checks the routes for problems that don't need the resources to be parsed:
+// missing or duplicate IDs, and malformed hosts and paths.
+func (c *Config) validateRoutes(report *router.ValidationReport) {
+	ids := make(map[string]bool)
+	for i, route := range c.Routes {
+		if route.Id == "" {
+			report.Add("", "Id", "route %d has no ID", i)
+		} else if ids[route.Id] {
+			report.Add(route.Id, "Id", "ID is used by more than one route")
+		}
+		ids[route.Id] = true
+
+		if err := router.ValidateHost(route.Host); err != nil {
+			report.Add(route.Id, "Host", "%v", err)
+		}
+		if !strings.HasPrefix(route.Route, "/") {
+			report.Add(route.Id, "Route", "path '%s' must begin with '/'", route.Route)
+		}
+		if route.Id == c.Router.NotFound && route.Host != "" {
+			report.Add(route.Id, "Host", "the NotFound route serves every host, so it can't have a host")
+		}
+	}
+
+	if c.Router.NotFound != "" && !ids[c.Router.NotFound] {
+		report.Add("", "Router", "NotFound route \"%s\" doesn't exist", c.Router.NotFound)
+	}
+}
+
+// Validate checks the config by building a router instance from it, without starting anything.
+// Returns a *router.ValidationReport if the config has problems.
+func (c *Config) Validate() error {
+	_, err := c.ToRouterInstance()
+	return err
+}
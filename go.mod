@@ -4,6 +4,8 @@ go 1.24.3
 
 require github.com/julienschmidt/httprouter v1.3.0
 
+require golang.org/x/crypto v0.39.0
+
 require (
 	github.com/mattn/go-colorable v0.1.14 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
@@ -0,0 +1,96 @@
+package middleware
+
+import (
+	"aspen/auth"
+	"aspen/router"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type APIKeyParams struct {
+	// Header the key is read from. Defaults to "X-API-Key". Keys are also read from "Authorization: Bearer".
+	Header string
+	// Query parameter the key is read from, if set. Keys in URLs can end up in logs, so prefer the header.
+	QueryParam string
+	// IDs of resources that don't need a key
+	Public []string
+	// Let requests without a key through, for later middleware to authenticate
+	Optional bool
+}
+
+// NewAPIKey creates middleware that authenticates machine clients with the API keys of the config.
+// The key is removed from the request, so it isn't passed on to upstreams.
+func NewAPIKey(params APIKeyParams) (router.MiddlewareFunc, error) {
+	header := params.Header
+	if header == "" {
+		header = "X-API-Key"
+	}
+	access := auth.Access{Public: params.Public}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			token := apiKeyToken(req, header, params.QueryParam)
+			if token == "" {
+				resource := router.RequestResource(req)
+				if params.Optional || auth.RequestIdentity(req) != nil || access.IsPublic(resource.GetID()) {
+					next.ServeHTTP(w, req)
+					return
+				}
+				router.Error(w, req, http.StatusUnauthorized, "API key required")
+				return
+			}
+
+			var key auth.APIKey
+			ok := false
+			if instance := router.RequestInstance(req); instance != nil {
+				key, ok = instance.APIKeys().Authenticate(token)
+			}
+			if !ok {
+				router.Error(w, req, http.StatusUnauthorized, "Invalid or expired API key")
+				return
+			}
+
+			req = auth.WithIdentity(req, &auth.Identity{Name: key.Name, Roles: key.Roles, Method: "api_key"})
+			next.ServeHTTP(w, req)
+		})
+	}, nil
+}
+
+// apiKeyToken reads an API key from the header, an "Authorization: Bearer" header holding one, or the query
+// parameter, and removes it from the request. Without the header the cache can't tell the request was keyed,
+// so it goes by the identity the middleware sets instead.
+func apiKeyToken(req *http.Request, header, queryParam string) string {
+	if token := req.Header.Get(header); token != "" {
+		req.Header.Del(header)
+		return token
+	}
+
+	scheme, token, _ := strings.Cut(req.Header.Get("Authorization"), " ")
+	if strings.EqualFold(scheme, "Bearer") && strings.HasPrefix(token, auth.APIKeyPrefix) {
+		req.Header.Del("Authorization")
+		return token
+	}
+
+	if queryParam != "" {
+		if token := req.URL.Query().Get(queryParam); token != "" {
+			req.URL.RawQuery = removeQueryParam(req.URL.RawQuery, queryParam)
+			return token
+		}
+	}
+	return ""
+}
+
+// removeQueryParam removes a parameter from a raw query, leaving the others in their order and escaping.
+func removeQueryParam(rawQuery, name string) string {
+	parts := strings.Split(rawQuery, "&")
+	kept := parts[:0]
+	for _, part := range parts {
+		key, _, _ := strings.Cut(part, "=")
+		if unescaped, err := url.QueryUnescape(key); err == nil && unescaped == name {
+			continue
+		}
+		kept = append(kept, part)
+	}
+	return strings.Join(kept, "&")
+}
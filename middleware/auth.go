@@ -0,0 +1,84 @@
+package middleware
+
+import (
+	"aspen/auth"
+	"aspen/router"
+	"fmt"
+	"net/http"
+)
+
+type AuthParams struct {
+	// Roles allowed on each resource, by resource ID. A user needs at least one of them.
+	// Resources without an entry are open to any authenticated user.
+	Roles map[string][]string
+	// IDs of resources that don't need authentication
+	Public []string
+	// Realm sent in the WWW-Authenticate header. Defaults to "Aspen".
+	Realm string
+}
+
+// NewAuth creates middleware that only lets authenticated users with the required roles through.
+// Requests are authenticated by earlier middleware, like a session, or with HTTP Basic credentials
+// checked against the config's users.
+func NewAuth(params AuthParams) (router.MiddlewareFunc, error) {
+	access := auth.Access{
+		Roles:  params.Roles,
+		Public: params.Public,
+	}
+	realm := params.Realm
+	if realm == "" {
+		realm = "Aspen"
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			resource := router.RequestResource(req)
+			if access.IsPublic(resource.GetID()) {
+				next.ServeHTTP(w, req)
+				return
+			}
+
+			identity := auth.RequestIdentity(req)
+			if identity == nil {
+				identity = basicAuth(req)
+				if identity == nil {
+					w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", realm))
+					router.Error(w, req, http.StatusUnauthorized, "Authentication required")
+					return
+				}
+
+				// The credentials are for Aspen, so don't pass them on to upstreams
+				req.Header.Del("Authorization")
+				req = auth.WithIdentity(req, identity)
+			}
+
+			if !access.Allows(identity, resource.GetID()) {
+				router.Error(w, req, http.StatusForbidden, fmt.Sprintf("User %s is not allowed to access this resource", identity.Name))
+				return
+			}
+			next.ServeHTTP(w, req)
+		})
+	}, nil
+}
+
+// basicAuth authenticates a request with its HTTP Basic credentials, returning nil if they are missing or wrong.
+func basicAuth(req *http.Request) *auth.Identity {
+	username, password, ok := req.BasicAuth()
+	if !ok {
+		return nil
+	}
+	instance := router.RequestInstance(req)
+	if instance == nil {
+		return nil
+	}
+
+	user, ok := instance.Users().Authenticate(username, password)
+	if !ok {
+		return nil
+	}
+	return &auth.Identity{
+		Name:   user.Username,
+		Roles:  user.Roles,
+		Method: "basic",
+	}
+}
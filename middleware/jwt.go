@@ -0,0 +1,219 @@
+package middleware
+
+import (
+	"aspen/auth"
+	"aspen/router"
+	"aspen/utils"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+type JWTKeyParams struct {
+	// Matched against the "kid" header of tokens, if both are set
+	ID string
+	// HS256, RS256 or ES256. Defaults to HS256 for secrets, and to the type of public keys.
+	Algorithm string
+	// HS256 secret, of at least 32 bytes
+	Secret string
+	// PEM encoded public key or certificate, or a file holding one
+	PublicKey     string
+	PublicKeyFile string
+}
+
+type JWTParams struct {
+	// Header the token is read from. Defaults to "Authorization", where it needs a "Bearer " prefix.
+	Header string
+	// Cookie the token is read from, if it isn't in the header
+	Cookie string
+
+	Keys []JWTKeyParams
+	// JSON Web Key Set file to read keys from, in addition to Keys
+	JWKSFile string
+
+	// Required "iss" claim
+	Issuer string
+	// The "aud" claim must include one of these
+	Audience []string
+	// Clock skew allowed when checking "exp" and "nbf"
+	Leeway utils.Duration
+	// Reject tokens without an "exp" claim. Defaults to true, since tokens without one never expire.
+	RequireExpiry *bool
+
+	// Claim naming the user. Defaults to "sub".
+	UsernameClaim string
+	// Claim holding the user's roles, as a list or space separated string. Dotted names look inside objects.
+	// Defaults to "roles".
+	RolesClaim string
+	// Maps values of the roles claim to Aspen roles. Without it, the values are the roles.
+	RoleMap map[string][]string
+	// Claims to pass on to upstreams, by the header they are sent in. Clients can't set these headers themselves.
+	ForwardClaims map[string]string
+
+	// IDs of resources that don't need a token
+	Public []string
+	// Let requests without a token through, for later middleware to authenticate
+	Optional bool
+}
+
+// NewJWT creates middleware that authenticates requests with a signed JWT, checking its "exp", "nbf", "iss" and "aud" claims.
+func NewJWT(params JWTParams) (router.MiddlewareFunc, error) {
+	keys, err := jwtKeys(params)
+	if err != nil {
+		return nil, err
+	}
+	verifier := &auth.JWTVerifier{
+		Keys:     keys,
+		Issuer:   params.Issuer,
+		Audience: params.Audience,
+		Leeway:   params.Leeway.Std(),
+	}
+	if params.RequireExpiry != nil {
+		verifier.AllowNoExpiry = !*params.RequireExpiry
+	}
+
+	header := params.Header
+	if header == "" {
+		header = "Authorization"
+	}
+	usernameClaim := params.UsernameClaim
+	if usernameClaim == "" {
+		usernameClaim = "sub"
+	}
+	rolesClaim := params.RolesClaim
+	if rolesClaim == "" {
+		rolesClaim = "roles"
+	}
+	access := auth.Access{Public: params.Public}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			// Headers for claims only ever come from verified tokens
+			for _, name := range params.ForwardClaims {
+				req.Header.Del(name)
+			}
+
+			token := bearerToken(req, header, params.Cookie)
+			if token == "" {
+				resource := router.RequestResource(req)
+				if params.Optional || auth.RequestIdentity(req) != nil || access.IsPublic(resource.GetID()) {
+					next.ServeHTTP(w, req)
+					return
+				}
+				w.Header().Set("WWW-Authenticate", `Bearer realm="Aspen"`)
+				router.Error(w, req, http.StatusUnauthorized, "Authentication required")
+				return
+			}
+
+			claims, err := verifier.Verify(token)
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer realm=\"Aspen\", error=\"invalid_token\", error_description=%q", err.Error()))
+				router.Error(w, req, http.StatusUnauthorized, "Invalid token: "+err.Error())
+				return
+			}
+
+			for claim, name := range params.ForwardClaims {
+				if value, ok := claims.String(claim); ok {
+					req.Header.Set(name, value)
+				}
+			}
+			username, _ := claims.String(usernameClaim)
+			req = auth.WithIdentity(req, &auth.Identity{
+				Name:   username,
+				Roles:  auth.MapRoles(claims.Strings(rolesClaim), params.RoleMap),
+				Method: "jwt",
+			})
+			next.ServeHTTP(w, req)
+		})
+	}, nil
+}
+
+// jwtKeys reads the configured keys and JWKS file.
+func jwtKeys(params JWTParams) ([]auth.JWTKey, error) {
+	var keys []auth.JWTKey
+	for i, keyParams := range params.Keys {
+		key, err := keyParams.parse()
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %w", i, err)
+		}
+		keys = append(keys, key)
+	}
+
+	if params.JWKSFile != "" {
+		data, err := os.ReadFile(params.JWKSFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading JWKS file: %w", err)
+		}
+		jwks, err := auth.ParseJWKS(data)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, jwks...)
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no keys to verify tokens with")
+	}
+	return keys, nil
+}
+
+func (kp JWTKeyParams) parse() (auth.JWTKey, error) {
+	if kp.Secret != "" {
+		if kp.PublicKey != "" || kp.PublicKeyFile != "" {
+			return auth.JWTKey{}, errors.New("a key has either a Secret or a public key")
+		}
+		algorithm := kp.Algorithm
+		if algorithm == "" {
+			algorithm = auth.HS256
+		}
+		return auth.NewJWTKey(kp.ID, algorithm, []byte(kp.Secret))
+	}
+
+	pemData := []byte(kp.PublicKey)
+	if kp.PublicKeyFile != "" {
+		data, err := os.ReadFile(kp.PublicKeyFile)
+		if err != nil {
+			return auth.JWTKey{}, fmt.Errorf("error reading public key: %w", err)
+		}
+		pemData = data
+	}
+	if len(pemData) == 0 {
+		return auth.JWTKey{}, errors.New("key has no Secret, PublicKey or PublicKeyFile")
+	}
+	publicKey, err := auth.ParsePublicKey(pemData)
+	if err != nil {
+		return auth.JWTKey{}, fmt.Errorf("error parsing public key: %w", err)
+	}
+	algorithm := kp.Algorithm
+	if algorithm == "" {
+		if algorithm, err = auth.KeyAlgorithm(publicKey); err != nil {
+			return auth.JWTKey{}, err
+		}
+	}
+	return auth.NewJWTKey(kp.ID, algorithm, publicKey)
+}
+
+// bearerToken reads a token from the header, or from the cookie if the header has none.
+// Tokens in the Authorization header need the "Bearer" scheme.
+func bearerToken(req *http.Request, header, cookie string) string {
+	value := strings.TrimSpace(req.Header.Get(header))
+	if value != "" && strings.EqualFold(header, "Authorization") {
+		scheme, token, ok := strings.Cut(value, " ")
+		if ok && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+		value = ""
+	}
+	if value != "" {
+		return value
+	}
+
+	if cookie != "" {
+		if c, err := req.Cookie(cookie); err == nil {
+			return c.Value
+		}
+	}
+	return ""
+}
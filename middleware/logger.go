@@ -3,15 +3,28 @@ package middleware
 import (
 	"aspen/router"
 	"net/http"
+	"time"
 
-	"github.com/julienschmidt/httprouter"
 	"github.com/rs/zerolog/log"
 )
 
-type Logger struct{}
+// Logger logs each request once it has been handled, with the resource that handled it,
+// the response status and size, and how long it took.
+func Logger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		rw := router.WrapResponseWriter(w)
+		next.ServeHTTP(rw, req)
 
-// Handle logs the request method, path, and the resource handling this request.
-func (l Logger) Handle(res router.BaseResource, w http.ResponseWriter, req *http.Request, ps httprouter.Params) (error, int) {
-	log.Info().Str("method", req.Method).Str("path", req.URL.Path).Str("resource", res.GetID()).Msg("Request received")
-	return nil, http.StatusOK
+		resource := router.RequestResource(req)
+		log.Info().
+			Str("method", req.Method).
+			Str("path", req.URL.Path).
+			Str("resource", resource.GetID()).
+			Str("request_id", router.RequestID(req)).
+			Int("status", rw.Status()).
+			Int64("bytes", rw.BytesWritten()).
+			Dur("duration", time.Since(start)).
+			Msg("Request handled")
+	})
 }
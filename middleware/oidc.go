@@ -0,0 +1,231 @@
+package middleware
+
+import (
+	"aspen/auth"
+	"aspen/router"
+	"aspen/utils"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// How long a user has to log in at the provider before the login has to start again
+const oidcLoginTimeout = 10 * time.Minute
+
+type OIDCParams struct {
+	// Issuer URL of the provider, where "/.well-known/openid-configuration" is discovered
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// Full URL the provider sends users back to. Its path must be under a route using this middleware.
+	RedirectURL string
+	// Defaults to "openid", "profile" and "email"
+	Scopes []string
+
+	// Claim naming the user. Defaults to "preferred_username", falling back to "sub".
+	UsernameClaim string
+	// Claim holding the user's groups, as a list or space separated string. Dotted names look inside objects.
+	// Defaults to "groups".
+	RolesClaim string
+	// Maps values of the roles claim to Aspen roles. Without it, the values are the roles.
+	RoleMap map[string][]string
+
+	// A POST from this site ends the session, then redirects to PostLogoutURL, or to the provider's logout page
+	// if that is empty
+	LogoutPath    string
+	PostLogoutURL string
+	// Name of the session cookie. Defaults to "aspen_oidc".
+	CookieName string
+	// Clock skew allowed when checking ID tokens
+	Leeway utils.Duration
+
+	// IDs of resources that don't need a login
+	Public []string
+}
+
+// oidcSession is stored in the session cookie once a user has logged in.
+type oidcSession struct {
+	Name    string   `json:"n"`
+	Roles   []string `json:"r"`
+	Expires int64    `json:"e"`
+}
+
+// oidcLogin is stored in a cookie while the user logs in at the provider.
+type oidcLogin struct {
+	State    string `json:"s"`
+	Nonce    string `json:"n"`
+	Verifier string `json:"v"`
+	Return   string `json:"r"`
+}
+
+// NewOIDC creates middleware that logs browsers in with an OpenID Connect provider, using the authorization code
+// flow with PKCE. Logged in users get a session cookie, encrypted with the key of the config's Sessions.
+func NewOIDC(params OIDCParams) (router.MiddlewareFunc, error) {
+	if params.Issuer == "" || params.ClientID == "" || params.RedirectURL == "" {
+		return nil, errors.New("Issuer, ClientID and RedirectURL are required")
+	}
+	redirectURL, err := url.Parse(params.RedirectURL)
+	if err != nil || !redirectURL.IsAbs() {
+		return nil, errors.New("RedirectURL must be an absolute URL")
+	}
+	callbackPath := redirectURL.Path
+
+	scopes := params.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "profile", "email"}
+	}
+	rolesClaim := params.RolesClaim
+	if rolesClaim == "" {
+		rolesClaim = "groups"
+	}
+	cookieName := params.CookieName
+	if cookieName == "" {
+		cookieName = "aspen_oidc"
+	}
+	loginCookieName := cookieName + "_login"
+	access := auth.Access{Public: params.Public}
+
+	provider := &auth.OIDCProvider{
+		Issuer:       params.Issuer,
+		ClientID:     params.ClientID,
+		ClientSecret: params.ClientSecret,
+		RedirectURL:  params.RedirectURL,
+		Scopes:       scopes,
+		Leeway:       params.Leeway.Std(),
+		Client:       &http.Client{Timeout: 10 * time.Second},
+	}
+
+	usernameClaims := []string{"preferred_username", "sub"}
+	if params.UsernameClaim != "" {
+		usernameClaims = []string{params.UsernameClaim, "sub"}
+	}
+	// newSession reads the name and roles of a user from their ID token
+	newSession := func(claims auth.Claims, maxAge time.Duration) oidcSession {
+		var name string
+		for _, claim := range usernameClaims {
+			if name, _ = claims.String(claim); name != "" {
+				break
+			}
+		}
+		return oidcSession{
+			Name:    name,
+			Roles:   auth.MapRoles(claims.Strings(rolesClaim), params.RoleMap),
+			Expires: time.Now().Add(maxAge).Unix(),
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			instance := router.RequestInstance(req)
+			if instance == nil || instance.Sessions() == nil {
+				router.Error(w, req, http.StatusInternalServerError, "Sessions are not configured")
+				return
+			}
+			sessions := instance.Sessions()
+
+			if req.URL.Path == callbackPath {
+				var login oidcLogin
+				if !sessions.Open(req, loginCookieName, &login) {
+					router.Error(w, req, http.StatusBadRequest, "Login expired, please try again")
+					return
+				}
+				http.SetCookie(w, sessions.Expire(loginCookieName))
+
+				query := req.URL.Query()
+				if !auth.TokensEqual(query.Get("state"), login.State) {
+					router.Error(w, req, http.StatusBadRequest, "Login state doesn't match, please try again")
+					return
+				}
+				if providerError := query.Get("error"); providerError != "" {
+					log.Warn().Str("error", providerError).Str("description", query.Get("error_description")).Msg("OIDC provider refused login")
+					router.Error(w, req, http.StatusUnauthorized, "Login failed: "+providerError)
+					return
+				}
+
+				claims, err := provider.Exchange(req.Context(), query.Get("code"), login.Verifier, login.Nonce)
+				if err != nil {
+					log.Error().Err(err).Str("request_id", router.RequestID(req)).Msg("Error completing OIDC login")
+					router.Error(w, req, http.StatusBadGateway, "Unable to complete login")
+					return
+				}
+
+				session := newSession(claims, sessions.MaxAge())
+				cookie, err := sessions.Seal(cookieName, session, sessions.MaxAge())
+				if err != nil {
+					router.Error(w, req, http.StatusInternalServerError, "Unable to start session")
+					return
+				}
+				http.SetCookie(w, cookie)
+				log.Info().Str("user", session.Name).Str("request_id", router.RequestID(req)).Msg("Logged in with OIDC")
+				http.Redirect(w, req, login.Return, http.StatusSeeOther)
+				return
+			}
+
+			// Logging out changes state, so like the login resource it only takes a POST from this site,
+			// and other sites can't log users out with a link or image
+			if params.LogoutPath != "" && req.URL.Path == params.LogoutPath {
+				if req.Method != http.MethodPost {
+					w.Header().Set("Allow", http.MethodPost)
+					router.Error(w, req, http.StatusMethodNotAllowed, "Logging out needs a POST")
+					return
+				}
+				if !auth.SameOrigin(req) {
+					router.Error(w, req, http.StatusForbidden, "Cross-origin logout is not allowed")
+					return
+				}
+				http.SetCookie(w, sessions.Expire(cookieName))
+				target := params.PostLogoutURL
+				if target == "" {
+					target = provider.EndSessionURL(req.Context())
+				}
+				if target == "" {
+					target = "/"
+				}
+				http.Redirect(w, req, target, http.StatusSeeOther)
+				return
+			}
+
+			var session oidcSession
+			if sessions.Open(req, cookieName, &session) && time.Now().Unix() < session.Expires {
+				req = auth.WithIdentity(req, &auth.Identity{Name: session.Name, Roles: session.Roles, Method: "oidc"})
+				next.ServeHTTP(w, req)
+				return
+			}
+
+			resource := router.RequestResource(req)
+			if auth.RequestIdentity(req) != nil || access.IsPublic(resource.GetID()) {
+				next.ServeHTTP(w, req)
+				return
+			}
+			if !isBrowser(req) {
+				router.Error(w, req, http.StatusUnauthorized, "Authentication required")
+				return
+			}
+
+			login := oidcLogin{
+				State:    auth.RandomToken(),
+				Nonce:    auth.RandomToken(),
+				Verifier: auth.RandomToken(),
+				Return:   req.URL.RequestURI(),
+			}
+			target, err := provider.AuthCodeURL(req.Context(), login.State, login.Nonce, login.Verifier)
+			if err != nil {
+				log.Error().Err(err).Str("request_id", router.RequestID(req)).Msg("Error starting OIDC login")
+				router.Error(w, req, http.StatusBadGateway, "Unable to reach the identity provider")
+				return
+			}
+			cookie, err := sessions.Seal(loginCookieName, login, oidcLoginTimeout)
+			if err != nil {
+				router.Error(w, req, http.StatusInternalServerError, "Unable to start login")
+				return
+			}
+			// The provider redirects back from another site, which Strict cookies aren't sent on
+			cookie.SameSite = http.SameSiteLaxMode
+			http.SetCookie(w, cookie)
+			http.Redirect(w, req, target, http.StatusSeeOther)
+		})
+	}, nil
+}
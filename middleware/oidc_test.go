@@ -0,0 +1,321 @@
+package middleware
+
+import (
+	"aspen/auth"
+	"aspen/router"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// testProvider is a stand-in OpenID Connect provider, which logs in a fixed user without asking.
+type testProvider struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	lock  sync.Mutex
+	codes map[string]url.Values
+	// Number of logins started, and a nonce to put in ID tokens instead of the right one
+	logins   int
+	badNonce string
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testProvider{key: key, codes: make(map[string]url.Values)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint":         p.URL + "/token",
+			"jwks_uri":               p.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString([]byte{1, 0, 1}),
+		}}})
+	})
+	mux.HandleFunc("GET /authorize", func(w http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+		if query.Get("client_id") != "aspen" || query.Get("code_challenge_method") != "S256" || query.Get("response_type") != "code" {
+			http.Error(w, "bad authorization request", http.StatusBadRequest)
+			return
+		}
+		code := auth.RandomToken()
+		p.lock.Lock()
+		p.codes[code] = query
+		p.logins++
+		p.lock.Unlock()
+
+		redirect, _ := url.Parse(query.Get("redirect_uri"))
+		redirect.RawQuery = url.Values{"code": {code}, "state": {query.Get("state")}}.Encode()
+		http.Redirect(w, req, redirect.String(), http.StatusFound)
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, req *http.Request) {
+		client, secret, _ := req.BasicAuth()
+		p.lock.Lock()
+		authorization, ok := p.codes[req.PostFormValue("code")]
+		delete(p.codes, req.PostFormValue("code"))
+		p.lock.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case client != "aspen" || secret != "shh":
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error":"invalid_client"}`)
+		case !ok || req.PostFormValue("redirect_uri") != authorization.Get("redirect_uri") ||
+			auth.PKCEChallenge(req.PostFormValue("code_verifier")) != authorization.Get("code_challenge"):
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"invalid_grant"}`)
+		default:
+			nonce := authorization.Get("nonce")
+			if p.badNonce != "" {
+				nonce = p.badNonce
+			}
+			json.NewEncoder(w).Encode(map[string]string{"id_token": p.idToken(t, map[string]any{
+				"iss":                p.URL,
+				"aud":                "aspen",
+				"sub":                "u-123",
+				"preferred_username": "alice",
+				"groups":             []string{"engineering", "everyone"},
+				"nonce":              nonce,
+				"exp":                time.Now().Add(time.Hour).Unix(),
+			})})
+		}
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+func (p *testProvider) idToken(t *testing.T, claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// whoami responds with the identity of the request.
+type whoami struct {
+	router.BaseResource
+}
+
+func (wr *whoami) AddHandlers(path string, r *router.RouterInstance) error {
+	handle := func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		identity := auth.RequestIdentity(req)
+		if identity == nil {
+			fmt.Fprint(w, "anonymous")
+			return
+		}
+		fmt.Fprintf(w, "%s %s %s", identity.Name, identity.Method, strings.Join(identity.Roles, ","))
+	}
+	r.GET(path, wr.BaseResource, handle)
+	r.POST(path, wr.BaseResource, handle)
+	return nil
+}
+
+// newOIDCServer serves "/app/*path" behind the oidc middleware, and "/public" without a login.
+func newOIDCServer(t *testing.T, provider *testProvider) *httptest.Server {
+	server := httptest.NewServer(&router.GlobalRouter)
+	t.Cleanup(server.Close)
+
+	oidc, err := NewOIDC(OIDCParams{
+		Issuer:       provider.URL,
+		ClientID:     "aspen",
+		ClientSecret: "shh",
+		RedirectURL:  server.URL + "/app/oauth2/callback",
+		RoleMap:      map[string][]string{"engineering": {"admin"}},
+		LogoutPath:   "/app/logout",
+		Public:       []string{"public"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessionOptions := auth.DefaultSessionOptions()
+	sessionOptions.Secure = false
+	sessions, err := auth.NewSessions(strings.Repeat("s", auth.MinSessionSecretLength), sessionOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := router.DefaultOptions()
+	options.Sessions = sessions
+	router.UpdateRouter(router.NewRouterInstance(options, []router.MiddlewareFunc{oidc}, nil, nil, []router.Route{
+		{Path: "/app/*path", Resource: &whoami{router.NewBaseResource("app")}},
+		{Path: "/public", Resource: &whoami{router.NewBaseResource("public")}},
+	}))
+	return server
+}
+
+func newBrowser(t *testing.T) *http.Client {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{Jar: jar}
+}
+
+func browse(t *testing.T, client *http.Client, target string) (int, string) {
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "text/html")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, strings.TrimSpace(string(body))
+}
+
+// logout posts to the logout path, from a page of the given origin.
+func logout(t *testing.T, client *http.Client, target, origin string) int {
+	req, err := http.NewRequest(http.MethodPost, target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Origin", origin)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestOIDCLogin(t *testing.T) {
+	provider := newTestProvider(t)
+	server := newOIDCServer(t, provider)
+	browser := newBrowser(t)
+
+	// The browser is sent to the provider, and comes back logged in to the page it asked for
+	status, body := browse(t, browser, server.URL+"/app/reports?year=2024")
+	if status != http.StatusOK || body != "alice oidc admin" {
+		t.Fatalf("login: got %d %q", status, body)
+	}
+
+	// Later requests use the session
+	status, body = browse(t, browser, server.URL+"/app/other")
+	if status != http.StatusOK || body != "alice oidc admin" || provider.logins != 1 {
+		t.Fatalf("session: got %d %q after %d logins", status, body, provider.logins)
+	}
+
+	// Other sites can't log the user out
+	browser.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	if status, _ = browse(t, browser, server.URL+"/app/logout"); status != http.StatusMethodNotAllowed {
+		t.Errorf("logout with GET: got %d, want 405", status)
+	}
+	if status = logout(t, browser, server.URL+"/app/logout", "https://evil.example"); status != http.StatusForbidden {
+		t.Errorf("cross-origin logout: got %d, want 403", status)
+	}
+	status, body = browse(t, browser, server.URL+"/app/other")
+	if status != http.StatusOK || body != "alice oidc admin" {
+		t.Fatalf("after refused logouts: got %d %q", status, body)
+	}
+
+	// Logging out ends the session, so the next request logs in again
+	if status = logout(t, browser, server.URL+"/app/logout", server.URL); status != http.StatusSeeOther {
+		t.Fatalf("logout: got %d", status)
+	}
+	status, _ = browse(t, browser, server.URL+"/app/other")
+	if status != http.StatusSeeOther {
+		t.Fatalf("after logout: got %d, want a redirect to the provider", status)
+	}
+}
+
+func TestOIDCUnauthenticated(t *testing.T) {
+	provider := newTestProvider(t)
+	server := newOIDCServer(t, provider)
+
+	// Clients that aren't browsers aren't redirected
+	resp, err := http.Get(server.URL + "/app/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("API client: got %d, want 401", resp.StatusCode)
+	}
+
+	// Credentials nothing has verified don't skip the login
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/app/data", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer forged")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("forged Authorization header: got %d, want 401", resp.StatusCode)
+	}
+
+	status, body := browse(t, newBrowser(t), server.URL+"/public")
+	if status != http.StatusOK || body != "anonymous" || provider.logins != 0 {
+		t.Errorf("public resource: got %d %q after %d logins", status, body, provider.logins)
+	}
+}
+
+func TestOIDCRejectsForgedCallbacks(t *testing.T) {
+	provider := newTestProvider(t)
+	server := newOIDCServer(t, provider)
+	browser := newBrowser(t)
+	browser.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+
+	// A callback without a login in progress
+	status, _ := browse(t, browser, server.URL+"/app/oauth2/callback?code=x&state=y")
+	if status != http.StatusBadRequest {
+		t.Errorf("callback without login: got %d, want 400", status)
+	}
+
+	// A callback whose state doesn't match the login in progress
+	if status, _ := browse(t, browser, server.URL+"/app/"); status != http.StatusSeeOther {
+		t.Fatalf("starting login: got %d", status)
+	}
+	status, _ = browse(t, browser, server.URL+"/app/oauth2/callback?code=x&state=forged")
+	if status != http.StatusBadRequest {
+		t.Errorf("callback with forged state: got %d, want 400", status)
+	}
+
+	// An ID token issued for another login
+	provider.badNonce = "replayed"
+	browser.CheckRedirect = nil
+	status, body := browse(t, browser, server.URL+"/app/")
+	if status != http.StatusBadGateway {
+		t.Errorf("ID token with wrong nonce: got %d %q, want 502", status, body)
+	}
+}
@@ -3,5 +3,10 @@ package middleware
 import "aspen/config"
 
 func RegisterMiddleware() {
-	config.RegisterMiddleware("logger", Logger{})
+	config.RegisterMiddlewareFunc("logger", Logger)
+	config.RegisterMiddlewareConstructor("auth", NewAuth)
+	config.RegisterMiddlewareConstructor("session", NewSession)
+	config.RegisterMiddlewareConstructor("jwt", NewJWT)
+	config.RegisterMiddlewareConstructor("oidc", NewOIDC)
+	config.RegisterMiddlewareConstructor("api_key", NewAPIKey)
 }
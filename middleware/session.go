@@ -0,0 +1,98 @@
+package middleware
+
+import (
+	"aspen/auth"
+	"aspen/router"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type SessionParams struct {
+	// Path of the login resource that browsers are sent to. Defaults to "/login".
+	LoginPath string
+	// IDs of resources that don't need a session
+	Public []string
+}
+
+// NewSession creates middleware that authenticates requests with the session cookie of the login resource.
+// Browsers without a session are redirected to the login page, with a link back to where they were going.
+// Other clients get a 401. Requests authenticated by earlier middleware, like jwt or api_key, are let through.
+func NewSession(params SessionParams) (router.MiddlewareFunc, error) {
+	access := auth.Access{Public: params.Public}
+	loginPath := params.LoginPath
+	if loginPath == "" {
+		loginPath = "/login"
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if auth.RequestIdentity(req) == nil {
+				if instance := router.RequestInstance(req); instance != nil && instance.Sessions() != nil {
+					if identity := instance.Sessions().Authenticate(w, req, instance.Users()); identity != nil {
+						req = auth.WithIdentity(req, identity)
+						// Like other credentials, the cookie isn't passed on, so upstreams can't read or replay it
+						removeCookie(req, instance.Sessions().CookieName())
+					}
+				}
+			}
+			if auth.RequestIdentity(req) != nil {
+				next.ServeHTTP(w, req)
+				return
+			}
+
+			resource := router.RequestResource(req)
+			if access.IsPublic(resource.GetID()) || isLoginPath(req.URL.Path, loginPath) {
+				next.ServeHTTP(w, req)
+				return
+			}
+
+			if isBrowser(req) {
+				target := loginPath + "?" + url.Values{"return": {req.URL.RequestURI()}}.Encode()
+				http.Redirect(w, req, target, http.StatusSeeOther)
+				return
+			}
+			router.Error(w, req, http.StatusUnauthorized, "Authentication required")
+		})
+	}, nil
+}
+
+// removeCookie removes a cookie from the request's Cookie headers, leaving the other cookies as they were sent.
+func removeCookie(req *http.Request, name string) {
+	values := req.Header.Values("Cookie")
+	kept := make([]string, 0, len(values))
+	removed := false
+	for _, value := range values {
+		var parts []string
+		for _, part := range strings.Split(value, ";") {
+			part = strings.TrimSpace(part)
+			if cookieName, _, _ := strings.Cut(part, "="); cookieName == name {
+				removed = true
+			} else if part != "" {
+				parts = append(parts, part)
+			}
+		}
+		if len(parts) > 0 {
+			kept = append(kept, strings.Join(parts, "; "))
+		}
+	}
+	if !removed {
+		return
+	}
+
+	req.Header.Del("Cookie")
+	for _, value := range kept {
+		req.Header.Add("Cookie", value)
+	}
+}
+
+// isLoginPath reports whether a path belongs to the login resource, which has to be reachable without a session.
+func isLoginPath(path, loginPath string) bool {
+	return path == loginPath || strings.HasPrefix(path, strings.TrimSuffix(loginPath, "/")+"/")
+}
+
+// isBrowser reports whether a request is a page load that can follow a redirect to the login form.
+func isBrowser(req *http.Request) bool {
+	return (req.Method == http.MethodGet || req.Method == http.MethodHead) &&
+		strings.Contains(req.Header.Get("Accept"), "text/html")
+}
@@ -0,0 +1,125 @@
+package middleware
+
+import (
+	"aspen/auth"
+	"aspen/router"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// newSessionServer serves "/app/*path" behind the session middleware, after the given middleware.
+func newSessionServer(t *testing.T, before ...router.MiddlewareFunc) (*httptest.Server, *auth.Sessions, auth.User) {
+	hash, err := auth.HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := auth.User{Username: "alice", PasswordHash: hash, Roles: []string{"admin"}}
+	users, err := auth.NewUsers([]auth.User{user})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessionOptions := auth.DefaultSessionOptions()
+	sessionOptions.Secure = false
+	sessions, err := auth.NewSessions(strings.Repeat("s", auth.MinSessionSecretLength), sessionOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session, err := NewSession(SessionParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := router.DefaultOptions()
+	options.Users = users
+	options.Sessions = sessions
+	router.UpdateRouter(router.NewRouterInstance(options, append(before, session), nil, nil, []router.Route{
+		{Path: "/app/*path", Resource: &whoami{router.NewBaseResource("app")}},
+		{Path: "/cookies", Resource: &cookies{router.NewBaseResource("cookies")}},
+	}))
+
+	server := httptest.NewServer(&router.GlobalRouter)
+	t.Cleanup(server.Close)
+	return server, sessions, user
+}
+
+// cookies responds with the Cookie header it was passed.
+type cookies struct {
+	router.BaseResource
+}
+
+func (cr *cookies) AddHandlers(path string, r *router.RouterInstance) error {
+	r.GET(path, cr.BaseResource, func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		io.WriteString(w, req.Header.Get("Cookie"))
+	})
+	return nil
+}
+
+func get(t *testing.T, target string, header http.Header) *http.Response {
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header = header
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestSessionRequiresLogin(t *testing.T) {
+	server, sessions, user := newSessionServer(t)
+
+	// Credentials nothing has verified don't get past the session check
+	resp := get(t, server.URL+"/app/data", http.Header{"Authorization": {"x"}})
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("bogus Authorization header: got %d, want 401", resp.StatusCode)
+	}
+	resp = get(t, server.URL+"/app/data", http.Header{"Authorization": {"Bearer forged"}, "Accept": {"text/html"}})
+	if location := resp.Header.Get("Location"); resp.StatusCode != http.StatusSeeOther || location != "/login?return=%2Fapp%2Fdata" {
+		t.Errorf("bogus Authorization header from a browser: got %d to %q, want a redirect to the login page", resp.StatusCode, location)
+	}
+
+	// A session cookie gets through
+	recorder := httptest.NewRecorder()
+	if err := sessions.Write(recorder, user); err != nil {
+		t.Fatal(err)
+	}
+	browser := newBrowser(t)
+	serverURL, _ := url.Parse(server.URL)
+	browser.Jar.SetCookies(serverURL, recorder.Result().Cookies())
+	status, body := browse(t, browser, server.URL+"/app/data")
+	if status != http.StatusOK || body != "alice session admin" {
+		t.Errorf("session: got %d %q", status, body)
+	}
+
+	// The session cookie isn't passed on, but other cookies are
+	browser.Jar.SetCookies(serverURL, []*http.Cookie{{Name: "theme", Value: "dark"}})
+	status, body = browse(t, browser, server.URL+"/cookies")
+	if status != http.StatusOK || body != "theme=dark" {
+		t.Errorf("cookies passed on: got %d %q, want only the theme cookie", status, body)
+	}
+}
+
+func TestSessionAllowsVerifiedIdentities(t *testing.T) {
+	verified := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			next.ServeHTTP(w, auth.WithIdentity(req, &auth.Identity{Name: "ci", Method: "api_key"}))
+		})
+	}
+	server, _, _ := newSessionServer(t, verified)
+
+	resp := get(t, server.URL+"/app/data", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("identity from earlier middleware: got %d, want 200", resp.StatusCode)
+	}
+}
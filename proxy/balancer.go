@@ -0,0 +1,317 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Load balancing strategies
+const (
+	RoundRobin       = "round_robin"
+	WeightedRandom   = "weighted_random"
+	LeastConnections = "least_connections"
+	ConsistentHash   = "consistent_hash"
+)
+
+// Number of points each unit of weight gets on the consistent hash ring
+const hashReplicas = 100
+
+// Balancer picks which upstream should handle a request. Implementations are safe for concurrent use.
+type Balancer interface {
+	// Next returns the upstream for the request, or nil if no upstream is available.
+	// Upstreams that are unhealthy or ejected are skipped.
+	Next(req *http.Request) *Upstream
+
+	// Upstreams returns all upstreams managed by this balancer.
+	Upstreams() []*Upstream
+}
+
+type BalancerOptions struct {
+	// One of RoundRobin (the default), WeightedRandom, LeastConnections or ConsistentHash.
+	Strategy string
+
+	// What the ConsistentHash strategy hashes: "ip" (the default) for the client IP,
+	// "header:<name>" for a request header, or "cookie:<name>" for a cookie.
+	HashOn string
+}
+
+// NewBalancer creates a balancer over the given upstreams using the configured strategy.
+func NewBalancer(upstreams []*Upstream, options BalancerOptions) (Balancer, error) {
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("balancer needs at least one upstream")
+	}
+
+	switch options.Strategy {
+	case "", RoundRobin:
+		return newRoundRobinBalancer(upstreams), nil
+	case WeightedRandom:
+		return newWeightedRandomBalancer(upstreams), nil
+	case LeastConnections:
+		return &leastConnectionsBalancer{upstreams: upstreams}, nil
+	case ConsistentHash:
+		key, err := parseHashKey(options.HashOn)
+		if err != nil {
+			return nil, err
+		}
+		return newConsistentHashBalancer(upstreams, key), nil
+	default:
+		return nil, fmt.Errorf("unknown load balancing strategy '%s'", options.Strategy)
+	}
+}
+
+/*
+ * ===========================================================
+ * Round robin
+ * ===========================================================
+ */
+
+// roundRobinBalancer uses smooth weighted round robin, which spreads out picks of heavier
+// upstreams instead of sending them in bursts.
+type roundRobinBalancer struct {
+	upstreams []*Upstream
+	current   []int
+	lock      sync.Mutex
+}
+
+func newRoundRobinBalancer(upstreams []*Upstream) *roundRobinBalancer {
+	return &roundRobinBalancer{
+		upstreams: upstreams,
+		current:   make([]int, len(upstreams)),
+	}
+}
+
+func (b *roundRobinBalancer) Next(req *http.Request) *Upstream {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	total := 0
+	best := -1
+	for i, upstream := range b.upstreams {
+		if !upstream.Available() {
+			continue
+		}
+		b.current[i] += upstream.weight
+		total += upstream.weight
+		if best == -1 || b.current[i] > b.current[best] {
+			best = i
+		}
+	}
+
+	if best == -1 {
+		return nil
+	}
+	b.current[best] -= total
+	return b.upstreams[best]
+}
+
+func (b *roundRobinBalancer) Upstreams() []*Upstream {
+	return b.upstreams
+}
+
+/*
+ * ===========================================================
+ * Weighted random
+ * ===========================================================
+ */
+
+type weightedRandomBalancer struct {
+	upstreams []*Upstream
+}
+
+func newWeightedRandomBalancer(upstreams []*Upstream) *weightedRandomBalancer {
+	return &weightedRandomBalancer{upstreams: upstreams}
+}
+
+func (b *weightedRandomBalancer) Next(req *http.Request) *Upstream {
+	// Only available upstreams take part in the draw. Availability is read once, so an upstream
+	// changing state during the draw can't leave the pick without a match.
+	available := make([]*Upstream, 0, len(b.upstreams))
+	total := 0
+	for _, upstream := range b.upstreams {
+		if upstream.Available() {
+			available = append(available, upstream)
+			total += upstream.weight
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+
+	pick := rand.IntN(total)
+	for _, upstream := range available {
+		if pick < upstream.weight {
+			return upstream
+		}
+		pick -= upstream.weight
+	}
+	return nil
+}
+
+func (b *weightedRandomBalancer) Upstreams() []*Upstream {
+	return b.upstreams
+}
+
+/*
+ * ===========================================================
+ * Least connections
+ * ===========================================================
+ */
+
+// leastConnectionsBalancer picks the upstream with the fewest in-flight requests relative to its weight.
+// Ties are broken by rotating the starting point, so idle upstreams share the load.
+type leastConnectionsBalancer struct {
+	upstreams []*Upstream
+	offset    atomic.Uint64
+}
+
+func (b *leastConnectionsBalancer) Next(req *http.Request) *Upstream {
+	start := int(b.offset.Add(1) % uint64(len(b.upstreams)))
+
+	var best *Upstream
+	for i := range b.upstreams {
+		upstream := b.upstreams[(start+i)%len(b.upstreams)]
+		if !upstream.Available() {
+			continue
+		}
+		// Compare active/weight without dividing: a/wa < b/wb <=> a*wb < b*wa
+		if best == nil || upstream.ActiveRequests()*int64(best.weight) < best.ActiveRequests()*int64(upstream.weight) {
+			best = upstream
+		}
+	}
+	return best
+}
+
+func (b *leastConnectionsBalancer) Upstreams() []*Upstream {
+	return b.upstreams
+}
+
+/*
+ * ===========================================================
+ * Consistent hash
+ * ===========================================================
+ */
+
+// hashKey extracts the value to hash from a request. Returns false if the request doesn't have one.
+type hashKey func(req *http.Request) (string, bool)
+
+func parseHashKey(hashOn string) (hashKey, error) {
+	kind, name, _ := strings.Cut(hashOn, ":")
+	switch kind {
+	case "", "ip":
+		return func(req *http.Request) (string, bool) {
+			ip := remoteIP(req)
+			return ip, ip != ""
+		}, nil
+	case "header":
+		if name == "" {
+			return nil, fmt.Errorf("hash key '%s' is missing a header name", hashOn)
+		}
+		return func(req *http.Request) (string, bool) {
+			value := req.Header.Get(name)
+			return value, value != ""
+		}, nil
+	case "cookie":
+		if name == "" {
+			return nil, fmt.Errorf("hash key '%s' is missing a cookie name", hashOn)
+		}
+		return func(req *http.Request) (string, bool) {
+			cookie, err := req.Cookie(name)
+			if err != nil {
+				return "", false
+			}
+			return cookie.Value, true
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown hash key '%s'", hashOn)
+	}
+}
+
+// consistentHashBalancer maps requests onto a hash ring, so the same key keeps going to the same
+// upstream and only a small share of keys move when upstreams are added or removed.
+// Requests without a key fall back to round robin.
+// If the owner of a key is unavailable, the key moves to the next available upstream on the ring.
+type consistentHashBalancer struct {
+	upstreams []*Upstream
+	key       hashKey
+	fallback  *roundRobinBalancer
+
+	// Sorted hashes of the ring points, and the upstream that owns each point
+	ring   []uint32
+	owners map[uint32]*Upstream
+}
+
+func newConsistentHashBalancer(upstreams []*Upstream, key hashKey) *consistentHashBalancer {
+	b := &consistentHashBalancer{
+		upstreams: upstreams,
+		key:       key,
+		fallback:  newRoundRobinBalancer(upstreams),
+		owners:    make(map[uint32]*Upstream),
+	}
+
+	for _, upstream := range upstreams {
+		for i := range upstream.weight * hashReplicas {
+			point := hashString(upstream.String() + "#" + strconv.Itoa(i))
+			if _, taken := b.owners[point]; taken {
+				continue
+			}
+			b.owners[point] = upstream
+			b.ring = append(b.ring, point)
+		}
+	}
+	sort.Slice(b.ring, func(i, j int) bool { return b.ring[i] < b.ring[j] })
+
+	return b
+}
+
+func (b *consistentHashBalancer) Next(req *http.Request) *Upstream {
+	key, ok := b.key(req)
+	if !ok {
+		return b.fallback.Next(req)
+	}
+
+	// Find the first point on the ring at or after the key's hash, wrapping around
+	hash := hashString(key)
+	start := sort.Search(len(b.ring), func(i int) bool { return b.ring[i] >= hash })
+	for i := range b.ring {
+		owner := b.owners[b.ring[(start+i)%len(b.ring)]]
+		if owner.Available() {
+			return owner
+		}
+	}
+	return nil
+}
+
+func (b *consistentHashBalancer) Upstreams() []*Upstream {
+	return b.upstreams
+}
+
+// hashString hashes s with FNV-1a, followed by a finalizer to spread similar keys across the ring.
+func hashString(s string) uint32 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return uint32(x)
+}
+
+// remoteIP returns the IP address of the directly connected client.
+func remoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,205 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultBreakerOpenDuration     = 30 * time.Second
+	defaultBreakerHalfOpenRequests = 1
+	defaultBreakerSuccessThreshold = 1
+)
+
+// BreakerOptions configures the circuit breaker kept for each upstream.
+//
+// A closed circuit lets all requests through. After FailureThreshold consecutive failures it opens,
+// and the upstream gets no requests for OpenDuration. It then becomes half-open, letting through up to
+// HalfOpenRequests trial requests at a time: SuccessThreshold successes close the circuit again,
+// while any failure opens it for another OpenDuration.
+type BreakerOptions struct {
+	// Consecutive failures (errors or 502/503/504 responses) that open the circuit.
+	// The circuit breaker is disabled if this is zero.
+	FailureThreshold int
+	// How long the circuit stays open, defaults to 30 seconds.
+	OpenDuration time.Duration
+	// Concurrent trial requests allowed while half-open, defaults to 1.
+	HalfOpenRequests int
+	// Successful trial requests needed to close the circuit, defaults to 1.
+	SuccessThreshold int
+}
+
+func (o BreakerOptions) withDefaults() BreakerOptions {
+	if o.OpenDuration <= 0 {
+		o.OpenDuration = defaultBreakerOpenDuration
+	}
+	if o.HalfOpenRequests <= 0 {
+		o.HalfOpenRequests = defaultBreakerHalfOpenRequests
+	}
+	if o.SuccessThreshold <= 0 {
+		o.SuccessThreshold = defaultBreakerSuccessThreshold
+	}
+	return o
+}
+
+type CircuitState int
+
+const (
+	CircuitClosed CircuitState = iota
+	CircuitOpen
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+func (s CircuitState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// circuitBreaker tracks the circuit state of a single upstream.
+type circuitBreaker struct {
+	options BreakerOptions
+
+	lock      sync.Mutex
+	state     CircuitState
+	failures  int
+	successes int
+	openUntil time.Time
+
+	// Trial requests currently in flight while half-open
+	trials int
+}
+
+// currentState returns the state, moving an open circuit to half-open once its time is up.
+// Must be called with the lock held.
+func (cb *circuitBreaker) currentState() CircuitState {
+	if cb.state == CircuitOpen && !time.Now().Before(cb.openUntil) {
+		cb.state = CircuitHalfOpen
+		cb.successes = 0
+		cb.trials = 0
+	}
+	return cb.state
+}
+
+// State returns the current circuit state.
+func (cb *circuitBreaker) State() CircuitState {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	return cb.currentState()
+}
+
+// available checks if the circuit could let a request through, without reserving anything.
+func (cb *circuitBreaker) available() bool {
+	if cb.options.FailureThreshold <= 0 {
+		return true
+	}
+
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	switch cb.currentState() {
+	case CircuitOpen:
+		return false
+	case CircuitHalfOpen:
+		return cb.trials < cb.options.HalfOpenRequests
+	default:
+		return true
+	}
+}
+
+// allow reserves a slot for a request, returning false if the circuit doesn't let it through.
+// Every allowed request must be followed by a call to report or release.
+func (cb *circuitBreaker) allow() bool {
+	if cb.options.FailureThreshold <= 0 {
+		return true
+	}
+
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	switch cb.currentState() {
+	case CircuitOpen:
+		return false
+	case CircuitHalfOpen:
+		if cb.trials >= cb.options.HalfOpenRequests {
+			return false
+		}
+		cb.trials++
+		return true
+	default:
+		return true
+	}
+}
+
+// report records the outcome of an allowed request.
+func (cb *circuitBreaker) report(u *Upstream, failed bool) {
+	if cb.options.FailureThreshold <= 0 {
+		return
+	}
+
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	switch cb.currentState() {
+	case CircuitHalfOpen:
+		if cb.trials > 0 {
+			cb.trials--
+		}
+		if failed {
+			cb.open(u)
+			return
+		}
+		cb.successes++
+		if cb.successes >= cb.options.SuccessThreshold {
+			cb.state = CircuitClosed
+			cb.failures = 0
+			log.Info().Stringer("upstream", u).Msg("Circuit closed")
+		}
+
+	case CircuitClosed:
+		if !failed {
+			cb.failures = 0
+			return
+		}
+		cb.failures++
+		if cb.failures >= cb.options.FailureThreshold {
+			cb.open(u)
+		}
+	}
+}
+
+// release gives back the slot of an allowed request without recording an outcome,
+// for requests that ended for reasons that say nothing about the upstream.
+func (cb *circuitBreaker) release() {
+	if cb.options.FailureThreshold <= 0 {
+		return
+	}
+
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	if cb.currentState() == CircuitHalfOpen && cb.trials > 0 {
+		cb.trials--
+	}
+}
+
+// open trips the circuit. Must be called with the lock held.
+func (cb *circuitBreaker) open(u *Upstream) {
+	cb.state = CircuitOpen
+	cb.openUntil = time.Now().Add(cb.options.OpenDuration)
+	cb.failures = 0
+	log.Warn().Stringer("upstream", u).Dur("duration", cb.options.OpenDuration).Msg("Circuit opened")
+}
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// newTestProxy serves a proxy in front of a single upstream.
+func newTestProxy(t *testing.T, upstream *Upstream, options Options) *httptest.Server {
+	balancer, err := NewBalancer([]*Upstream{upstream}, BalancerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := New(balancer, options)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		p.Forward(w, req, req.URL.Path)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// newSlowUpstream responds once the request is cancelled, or after a second.
+func newSlowUpstream(t *testing.T) *Upstream {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-req.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	t.Cleanup(server.Close)
+	upstream, err := NewUpstream(server.URL, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return upstream
+}
+
+// cancelledGet sends a request that the client gives up on before the upstream responds.
+func cancelledGet(t *testing.T, target string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		resp.Body.Close()
+		t.Fatalf("request wasn't cancelled, got %d", resp.StatusCode)
+	}
+}
+
+func TestBreakerIgnoresClientCancellation(t *testing.T) {
+	upstream := newSlowUpstream(t)
+	server := newTestProxy(t, upstream, Options{Breaker: BreakerOptions{FailureThreshold: 1}})
+
+	for range 3 {
+		cancelledGet(t, server.URL+"/slow")
+	}
+	// The proxy notices the client has gone shortly after it hangs up
+	time.Sleep(100 * time.Millisecond)
+	if state := upstream.breaker.State(); state != CircuitClosed {
+		t.Errorf("circuit is %s after cancelled requests, want closed", state)
+	}
+}
+
+func TestBreakerReleasesTrialOnClientCancellation(t *testing.T) {
+	upstream := newSlowUpstream(t)
+	server := newTestProxy(t, upstream, Options{Breaker: BreakerOptions{FailureThreshold: 1}})
+
+	// Let the open time run out, so the next request is the half-open trial
+	upstream.breaker.lock.Lock()
+	upstream.breaker.state = CircuitOpen
+	upstream.breaker.openUntil = time.Now()
+	upstream.breaker.lock.Unlock()
+
+	cancelledGet(t, server.URL+"/slow")
+	time.Sleep(100 * time.Millisecond)
+	if state := upstream.breaker.State(); state != CircuitHalfOpen {
+		t.Fatalf("circuit is %s after a cancelled trial, want half-open", state)
+	}
+	if !upstream.breaker.available() {
+		t.Error("cancelled trial request kept its slot")
+	}
+}
+
+// failingResolver is always ready, but can't resolve its upstream.
+type failingResolver struct{}
+
+func (failingResolver) Resolve() (*url.URL, error) {
+	return nil, errors.New("service is being rebuilt")
+}
+func (failingResolver) Ready() bool { return true }
+func (failingResolver) Invalidate() {}
+
+func TestBreakerReleasesTrialWhenResolvingFails(t *testing.T) {
+	upstream := NewResolvedUpstream("app", failingResolver{}, 1)
+	server := newTestProxy(t, upstream, Options{Breaker: BreakerOptions{FailureThreshold: 1}})
+
+	upstream.breaker.lock.Lock()
+	upstream.breaker.state = CircuitOpen
+	upstream.breaker.openUntil = time.Now()
+	upstream.breaker.lock.Unlock()
+
+	resp, err := http.Get(server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if !upstream.breaker.available() {
+		t.Error("request that was never sent kept its trial slot")
+	}
+}
+
+func TestBreakerReleasesUpgradeTrialWhenResolvingFails(t *testing.T) {
+	upstream := NewResolvedUpstream("app", failingResolver{}, 1)
+	server := newTestProxy(t, upstream, Options{Breaker: BreakerOptions{FailureThreshold: 1}})
+
+	upstream.breaker.lock.Lock()
+	upstream.breaker.state = CircuitOpen
+	upstream.breaker.openUntil = time.Now()
+	upstream.breaker.lock.Unlock()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if !upstream.breaker.available() {
+		t.Error("upgrade that was never sent kept its trial slot")
+	}
+}
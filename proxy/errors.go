@@ -0,0 +1,28 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// StatusForError maps an error from reaching an upstream to the status code returned to the client.
+// Having no available upstream becomes 503 Service Unavailable, timeouts become 504 Gateway Timeout,
+// and everything else (refused connections, DNS failures, broken responses) becomes 502 Bad Gateway.
+func StatusForError(err error) int {
+	if errors.Is(err, ErrNoUpstream) {
+		return http.StatusServiceUnavailable
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+
+	return http.StatusBadGateway
+}
@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ForwardedOptions configures the forwarding headers sent to upstreams.
+type ForwardedOptions struct {
+	// Forwarding headers from clients in these ranges are trusted and appended to.
+	// Headers from any other client are replaced, so clients can't spoof their address.
+	TrustedProxies []netip.Prefix
+}
+
+// ParseTrustedProxies parses a list of CIDR ranges, e.g. "10.0.0.0/8". Single addresses are also accepted.
+func ParseTrustedProxies(ranges []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(ranges))
+	for _, r := range ranges {
+		if !strings.Contains(r, "/") {
+			addr, err := netip.ParseAddr(r)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy '%s': %w", r, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy '%s': %w", r, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// trusts checks if the given address belongs to a trusted proxy.
+func (o ForwardedOptions) trusts(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	for _, prefix := range o.TrustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client that sent the request. If the request came through
+// trusted proxies, this is the closest address in X-Forwarded-For that isn't a trusted proxy.
+func (o ForwardedOptions) ClientIP(req *http.Request) string {
+	ip := remoteIP(req)
+	if !o.trusts(ip) {
+		return ip
+	}
+
+	// Walk back through the proxies that handled the request
+	forwardedFor := splitList(req.Header.Values("X-Forwarded-For"))
+	for i := len(forwardedFor) - 1; i >= 0; i-- {
+		ip = forwardedFor[i]
+		if !o.trusts(ip) {
+			return ip
+		}
+	}
+
+	if realIP := req.Header.Get("X-Real-IP"); len(forwardedFor) == 0 && realIP != "" {
+		return realIP
+	}
+	return ip
+}
+
+// setForwardedHeaders sets X-Forwarded-For, X-Forwarded-Proto, X-Forwarded-Host, X-Real-IP and
+// Forwarded (RFC 7239) on the outgoing headers, based on the incoming request.
+func (o ForwardedOptions) setForwardedHeaders(in *http.Request, out http.Header) {
+	remote := remoteIP(in)
+	trusted := o.trusts(remote)
+
+	proto := "http"
+	if in.TLS != nil {
+		proto = "https"
+	}
+
+	// X-Forwarded-For lists every hop, so add the client connected to us
+	forwardedFor := remote
+	if prior := strings.Join(in.Header.Values("X-Forwarded-For"), ", "); trusted && prior != "" {
+		forwardedFor = prior + ", " + remote
+	}
+	out.Set("X-Forwarded-For", forwardedFor)
+
+	// The original host and scheme are kept if a trusted proxy already set them
+	forwardedProto := proto
+	if prior := in.Header.Get("X-Forwarded-Proto"); trusted && prior != "" {
+		forwardedProto = prior
+	}
+	out.Set("X-Forwarded-Proto", forwardedProto)
+
+	forwardedHost := in.Host
+	if prior := in.Header.Get("X-Forwarded-Host"); trusted && prior != "" {
+		forwardedHost = prior
+	}
+	out.Set("X-Forwarded-Host", forwardedHost)
+
+	out.Set("X-Real-IP", o.ClientIP(in))
+
+	// Forwarded describes this hop, appended to any trusted prior hops
+	element := fmt.Sprintf("for=%s;host=%s;proto=%s", forwardedNode(remote), quoteForwarded(in.Host), proto)
+	if prior := strings.Join(in.Header.Values("Forwarded"), ", "); trusted && prior != "" {
+		element = prior + ", " + element
+	}
+	out.Set("Forwarded", element)
+}
+
+// forwardedNode formats an IP as a Forwarded node; IPv6 addresses must be bracketed and quoted.
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
+
+// quoteForwarded quotes a Forwarded value if it contains characters that aren't allowed in a token.
+func quoteForwarded(value string) string {
+	if strings.ContainsAny(value, `:[]"; ,=`) {
+		return `"` + strings.ReplaceAll(value, `"`, `\"`) + `"`
+	}
+	return value
+}
+
+// splitList splits comma separated header values into trimmed, non-empty items.
+func splitList(values []string) []string {
+	var items []string
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+	}
+	return items
+}
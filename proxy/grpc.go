@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// gRPC status codes for errors the proxy responds with itself.
+const (
+	GRPCDeadlineExceeded = 4
+	GRPCUnimplemented    = 12
+	GRPCUnavailable      = 14
+)
+
+// IsGRPCRequest checks if the request is a gRPC call.
+func IsGRPCRequest(req *http.Request) bool {
+	contentType := req.Header.Get("Content-Type")
+	return contentType == "application/grpc" || strings.HasPrefix(contentType, "application/grpc+") || strings.HasPrefix(contentType, "application/grpc;")
+}
+
+// WriteGRPCError responds with a gRPC error. gRPC clients expect errors as a status in a
+// "trailers-only" response, since they treat HTTP error statuses as protocol failures.
+func WriteGRPCError(w http.ResponseWriter, code int, message string) {
+	header := w.Header()
+	header.Set("Content-Type", "application/grpc")
+	header.Set("Grpc-Status", strconv.Itoa(code))
+	header.Set("Grpc-Message", encodeGRPCMessage(message))
+	w.WriteHeader(http.StatusOK)
+}
+
+// grpcCodeForError maps an error from reaching an upstream to a gRPC status code, like StatusForError.
+func grpcCodeForError(err error) int {
+	if StatusForError(err) == http.StatusGatewayTimeout {
+		return GRPCDeadlineExceeded
+	}
+	return GRPCUnavailable
+}
+
+// encodeGRPCMessage percent-encodes a status message as required for the Grpc-Message header.
+func encodeGRPCMessage(message string) string {
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c >= ' ' && c <= '~' && c != '%' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,279 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultHealthInterval      = 10 * time.Second
+	defaultHealthTimeout       = 2 * time.Second
+	defaultHealthyThreshold    = 2
+	defaultUnhealthyThreshold  = 3
+	defaultPassiveEjectionTime = 30 * time.Second
+)
+
+// HealthOptions configures how upstream health is tracked.
+//
+// Active checks periodically probe each upstream, and mark it unhealthy or healthy again after
+// enough consecutive failed or successful probes. Passive checks watch real traffic, and eject an
+// upstream for a while after too many consecutive failed requests.
+// Upstreams that are unhealthy or ejected are skipped by the balancer.
+type HealthOptions struct {
+	// Path to probe on each upstream. Active checks are disabled if this is empty.
+	Path string
+	// Time between probes, defaults to 10 seconds.
+	Interval time.Duration
+	// Time limit for each probe, defaults to 2 seconds.
+	Timeout time.Duration
+	// Status codes that count as healthy. If empty, any 2xx or 3xx status is healthy.
+	ExpectedStatus []int
+	// Consecutive successful probes before an unhealthy upstream is healthy again, defaults to 2.
+	HealthyThreshold int
+	// Consecutive failed probes before an upstream is unhealthy, defaults to 3.
+	UnhealthyThreshold int
+
+	// Consecutive failed requests (errors or 502/503/504 responses) before an upstream is ejected.
+	// Passive checks are disabled if this is zero.
+	MaxFailures int
+	// How long an upstream stays ejected, defaults to 30 seconds.
+	EjectionTime time.Duration
+}
+
+func (o HealthOptions) withDefaults() HealthOptions {
+	if o.Interval <= 0 {
+		o.Interval = defaultHealthInterval
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = defaultHealthTimeout
+	}
+	if o.HealthyThreshold <= 0 {
+		o.HealthyThreshold = defaultHealthyThreshold
+	}
+	if o.UnhealthyThreshold <= 0 {
+		o.UnhealthyThreshold = defaultUnhealthyThreshold
+	}
+	if o.EjectionTime <= 0 {
+		o.EjectionTime = defaultPassiveEjectionTime
+	}
+	return o
+}
+
+// upstreamHealth is the health state of a single upstream.
+type upstreamHealth struct {
+	// Read on every request, so kept outside of the lock
+	unhealthy    atomic.Bool
+	ejectedUntil atomic.Int64 // Unix nanoseconds
+
+	lock            sync.Mutex
+	probeSuccesses  int
+	probeFailures   int
+	requestFailures int
+	lastProbe       time.Time
+	lastError       string
+}
+
+// UpstreamStatus is a snapshot of an upstream's state, as reported by the API.
+type UpstreamStatus struct {
+	Host           string       `json:"host"`
+	Weight         int          `json:"weight"`
+	Healthy        bool         `json:"healthy"`
+	Ejected        bool         `json:"ejected"`
+	Circuit        CircuitState `json:"circuit"`
+	ActiveRequests int64        `json:"active_requests"`
+	LastProbe      time.Time    `json:"last_probe,omitzero"`
+	LastError      string       `json:"last_error,omitempty"`
+}
+
+// Available checks if the upstream should receive requests,
+// i.e. it is healthy, not ejected, and its circuit isn't open.
+func (u *Upstream) Available() bool {
+	if !u.ready() {
+		return false
+	}
+	if u.health.unhealthy.Load() {
+		return false
+	}
+	if time.Now().UnixNano() < u.health.ejectedUntil.Load() {
+		return false
+	}
+	return u.breaker.available()
+}
+
+// Status returns a snapshot of the upstream's state.
+func (u *Upstream) Status() UpstreamStatus {
+	u.health.lock.Lock()
+	defer u.health.lock.Unlock()
+
+	return UpstreamStatus{
+		Host:           u.String(),
+		Weight:         u.weight,
+		Healthy:        !u.health.unhealthy.Load(),
+		Ejected:        time.Now().UnixNano() < u.health.ejectedUntil.Load(),
+		Circuit:        u.breaker.State(),
+		ActiveRequests: u.ActiveRequests(),
+		LastProbe:      u.health.lastProbe,
+		LastError:      u.health.lastError,
+	}
+}
+
+// reportProbe records the result of an active health probe.
+func (u *Upstream) reportProbe(err error, options HealthOptions) {
+	u.health.lock.Lock()
+	defer u.health.lock.Unlock()
+
+	u.health.lastProbe = time.Now()
+	if err == nil {
+		u.health.probeFailures = 0
+		u.health.probeSuccesses++
+		if u.health.unhealthy.Load() && u.health.probeSuccesses >= options.HealthyThreshold {
+			u.health.unhealthy.Store(false)
+			u.health.lastError = ""
+			log.Info().Stringer("upstream", u).Msg("Upstream is healthy")
+		}
+		return
+	}
+
+	u.health.lastError = err.Error()
+	u.health.probeSuccesses = 0
+	u.health.probeFailures++
+	if !u.health.unhealthy.Load() && u.health.probeFailures >= options.UnhealthyThreshold {
+		u.health.unhealthy.Store(true)
+		log.Warn().Stringer("upstream", u).Err(err).Msg("Upstream is unhealthy")
+	}
+}
+
+// reportRequest records the outcome of a proxied request for passive health checks.
+func (u *Upstream) reportRequest(err error, options HealthOptions) {
+	if options.MaxFailures <= 0 {
+		return
+	}
+
+	u.health.lock.Lock()
+	defer u.health.lock.Unlock()
+
+	if err == nil {
+		u.health.requestFailures = 0
+		return
+	}
+
+	u.health.lastError = err.Error()
+	u.health.requestFailures++
+	if u.health.requestFailures >= options.MaxFailures {
+		u.health.requestFailures = 0
+		u.health.ejectedUntil.Store(time.Now().Add(options.EjectionTime).UnixNano())
+		log.Warn().Stringer("upstream", u).Err(err).Dur("duration", options.EjectionTime).Msg("Ejecting upstream after consecutive failures")
+	}
+}
+
+// isFailureStatus checks if an upstream response means the upstream itself is in trouble.
+func isFailureStatus(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// healthChecker runs active health probes against a set of upstreams.
+type healthChecker struct {
+	upstreams []*Upstream
+	options   HealthOptions
+	client    *http.Client
+
+	cancel context.CancelFunc
+	done   sync.WaitGroup
+}
+
+func newHealthChecker(upstreams []*Upstream, options HealthOptions, transport http.RoundTripper) *healthChecker {
+	return &healthChecker{
+		upstreams: upstreams,
+		options:   options,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   options.Timeout,
+			// A redirect is an answer, so don't follow it
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// Start launches a probe loop for each upstream.
+func (hc *healthChecker) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	hc.cancel = cancel
+
+	for _, upstream := range hc.upstreams {
+		hc.done.Add(1)
+		go func() {
+			defer hc.done.Done()
+			hc.run(ctx, upstream)
+		}()
+	}
+}
+
+// Stop ends all probe loops and waits for them to finish.
+func (hc *healthChecker) Stop() {
+	if hc.cancel != nil {
+		hc.cancel()
+		hc.done.Wait()
+	}
+}
+
+func (hc *healthChecker) run(ctx context.Context, upstream *Upstream) {
+	ticker := time.NewTicker(hc.options.Interval)
+	defer ticker.Stop()
+
+	for {
+		// Upstreams that can't be resolved yet have nothing to probe
+		if upstream.ready() {
+			err := hc.probe(ctx, upstream)
+			if ctx.Err() != nil {
+				return
+			}
+			upstream.reportProbe(err, hc.options)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe sends a single health check request to the upstream.
+func (hc *healthChecker) probe(ctx context.Context, upstream *Upstream) error {
+	target, err := upstream.resolve()
+	if err != nil {
+		return err
+	}
+
+	probeURL := targetURL(target, hc.options.Path)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, probeURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Host = hostHeader(probeURL)
+
+	resp, err := hc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if len(hc.options.ExpectedStatus) > 0 {
+		if !slices.Contains(hc.options.ExpectedStatus, resp.StatusCode) {
+			return fmt.Errorf("unexpected health check status %d", resp.StatusCode)
+		}
+	} else if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("unexpected health check status %d", resp.StatusCode)
+	}
+	return nil
+}
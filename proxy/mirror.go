@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultMirrorQueueSize    = 100
+	defaultMirrorWorkers      = 1
+	defaultMirrorTimeout      = 10 * time.Second
+	defaultMirrorMaxBodyBytes = 64 * 1024
+)
+
+// MirrorOptions configures shadow traffic sent to a mirror proxy.
+type MirrorOptions struct {
+	// Percentage of requests to mirror, from 0 to 100. Defaults to 100.
+	Percent float64
+	// Mirrored requests wait in a queue of QueueSize (default 100) for one of Workers (default 1).
+	// Requests arriving while the queue is full are not mirrored.
+	QueueSize int
+	Workers   int
+	// Time limit for each mirrored request (default 10s)
+	Timeout time.Duration
+	// Requests with larger bodies (default 64KiB) are not mirrored
+	MaxBodyBytes int64
+}
+
+func (o MirrorOptions) withDefaults() MirrorOptions {
+	if o.Percent <= 0 || o.Percent > 100 {
+		o.Percent = 100
+	}
+	if o.QueueSize <= 0 {
+		o.QueueSize = defaultMirrorQueueSize
+	}
+	if o.Workers <= 0 {
+		o.Workers = defaultMirrorWorkers
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = defaultMirrorTimeout
+	}
+	if o.MaxBodyBytes <= 0 {
+		o.MaxBodyBytes = defaultMirrorMaxBodyBytes
+	}
+	return o
+}
+
+// Mirror sends copies of requests to a shadow proxy in the background. Responses are discarded,
+// and mirrored requests never hold up or affect the original request.
+type Mirror struct {
+	proxy   *Proxy
+	options MirrorOptions
+
+	queue   chan mirrorJob
+	dropped atomic.Int64
+
+	cancel context.CancelFunc
+	wait   sync.WaitGroup
+}
+
+type mirrorJob struct {
+	req  *http.Request
+	path string
+}
+
+// NewMirror creates a mirror that sends requests through the given proxy.
+func NewMirror(proxy *Proxy, options MirrorOptions) *Mirror {
+	options = options.withDefaults()
+	return &Mirror{
+		proxy:   proxy,
+		options: options,
+		queue:   make(chan mirrorJob, options.QueueSize),
+	}
+}
+
+// Start starts the workers sending mirrored requests.
+func (m *Mirror) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+
+	for range m.options.Workers {
+		m.wait.Add(1)
+		go m.run(ctx)
+	}
+}
+
+// Stop stops the workers. Queued requests are dropped, and requests in flight are canceled.
+func (m *Mirror) Stop() {
+	if m.cancel == nil {
+		return
+	}
+	m.cancel()
+	m.wait.Wait()
+}
+
+// Dropped returns the number of requests that weren't mirrored because the queue was full.
+func (m *Mirror) Dropped() int64 {
+	return m.dropped.Load()
+}
+
+// Send queues a copy of the request to be mirrored to the given path. It must be called before the
+// original request is forwarded, since the body is buffered so both requests can read it.
+func (m *Mirror) Send(req *http.Request, path string) {
+	if isUpgradeRequest(req) || rand.Float64()*100 >= m.options.Percent {
+		return
+	}
+
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		// If the body is too large or can't be read, it isn't mirrored. The original request gets
+		// what was read followed by the rest, so it fails the same way if the body is broken.
+		buffered, rest, err := bufferBody(req.Body, m.options.MaxBodyBytes)
+		if err != nil || rest != nil {
+			req.Body = rest
+			return
+		}
+		body = buffered
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	// The copy outlives the original request, so it can't share its context
+	mirrored := req.Clone(context.Background())
+	if body != nil {
+		mirrored.Body = io.NopCloser(bytes.NewReader(body))
+		mirrored.ContentLength = int64(len(body))
+	}
+
+	select {
+	case m.queue <- mirrorJob{req: mirrored, path: path}:
+	default:
+		m.dropped.Add(1)
+		log.Debug().Str("path", req.URL.Path).Msg("Mirror queue is full, dropping mirrored request")
+	}
+}
+
+func (m *Mirror) run(ctx context.Context) {
+	defer m.wait.Done()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-m.queue:
+			m.forward(ctx, job)
+		}
+	}
+}
+
+func (m *Mirror) forward(ctx context.Context, job mirrorJob) {
+	ctx, cancel := context.WithTimeout(ctx, m.options.Timeout)
+	defer cancel()
+
+	m.proxy.Forward(discardResponse{header: make(http.Header)}, job.req.WithContext(ctx), job.path)
+}
+
+// discardResponse is a ResponseWriter that throws the response away.
+type discardResponse struct {
+	header http.Header
+}
+
+func (d discardResponse) Header() http.Header {
+	return d.header
+}
+
+func (d discardResponse) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (d discardResponse) WriteHeader(int) {}
@@ -0,0 +1,224 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Shared transport for all proxies. Unlike a http.Client it has no overall timeout,
+// so long downloads and streamed responses are only limited by the client going away.
+var defaultTransport = &http.Transport{
+	Proxy: proxyFromEnvironment,
+	DialContext: dialUnixSockets((&net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext),
+	ForceAttemptHTTP2:     true,
+	MaxIdleConns:          100,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ExpectContinueTimeout: 1 * time.Second,
+}
+
+// forwardKey is used to pass the state of a forwarded request through the ReverseProxy.
+type forwardKey struct{}
+
+type forward struct {
+	// Upstream request path
+	path string
+	// Upstream of the latest attempt, nil until one is picked
+	upstream *Upstream
+}
+
+// Proxy forwards requests to a set of upstream servers, picked by a Balancer.
+//
+// It is built on httputil.ReverseProxy, which strips hop-by-hop headers in both directions,
+// flushes streamed (chunked or SSE) responses as they arrive, and cancels the upstream
+// request when the client disconnects.
+type Proxy struct {
+	balancer Balancer
+	options  Options
+	reverse  *httputil.ReverseProxy
+	health   *healthChecker
+
+	transport *http.Transport
+}
+
+// Options configures optional proxy behaviour. The zero value is a plain proxy.
+type Options struct {
+	Upgrade   UpgradeOptions
+	Health    HealthOptions
+	Retry     RetryOptions
+	Breaker   BreakerOptions
+	Forwarded ForwardedOptions
+	Rewrite   RewriteOptions
+
+	// Transport for upstream connections, created with NewTransport. Defaults to a transport shared by all proxies.
+	Transport *http.Transport
+
+	// Writes the error response when no upstream could respond. Defaults to a plain text http.Error.
+	WriteError func(w http.ResponseWriter, req *http.Request, status int, message string)
+}
+
+// New creates a proxy forwarding to the upstreams of the given balancer.
+// The upstreams should not be shared with other proxies, since they track health for this proxy.
+func New(balancer Balancer, options Options) *Proxy {
+	options.Health = options.Health.withDefaults()
+	options.Retry = options.Retry.withDefaults()
+	options.Breaker = options.Breaker.withDefaults()
+	options.Rewrite = options.Rewrite.withDefaults()
+
+	p := &Proxy{
+		balancer:  balancer,
+		options:   options,
+		transport: options.Transport,
+	}
+	if p.transport == nil {
+		p.transport = defaultTransport
+	}
+	if p.options.WriteError == nil {
+		p.options.WriteError = func(w http.ResponseWriter, _ *http.Request, status int, message string) {
+			http.Error(w, message, status)
+		}
+	}
+	p.reverse = &httputil.ReverseProxy{
+		Rewrite:        p.rewrite,
+		Transport:      &upstreamTransport{proxy: p, base: p.transport},
+		ModifyResponse: p.modifyResponse,
+		ErrorHandler:   p.handleError,
+	}
+
+	for _, upstream := range balancer.Upstreams() {
+		upstream.breaker.options = options.Breaker
+	}
+	if options.Health.Path != "" {
+		p.health = newHealthChecker(balancer.Upstreams(), options.Health, p.transport)
+	}
+	return p
+}
+
+// Start begins active health checks, if they are configured.
+func (p *Proxy) Start() {
+	if p.health != nil {
+		p.health.Start()
+	}
+}
+
+// Stop ends active health checks.
+func (p *Proxy) Stop() {
+	if p.health != nil {
+		p.health.Stop()
+	}
+}
+
+// Balancer returns the balancer used to pick upstreams.
+func (p *Proxy) Balancer() Balancer {
+	return p.balancer
+}
+
+// Forward proxies the request to an upstream, using path as the upstream request path.
+// The query string of the original request is preserved.
+func (p *Proxy) Forward(w http.ResponseWriter, req *http.Request, path string) {
+	if isUpgradeRequest(req) {
+		if !p.options.Upgrade.Disabled {
+			p.forwardUpgrade(w, req, path)
+			return
+		}
+
+		// Servers are free to ignore upgrades, so forward it as a regular request
+		req = req.Clone(req.Context())
+		removeUpgradeHeaders(req.Header)
+	}
+
+	ctx := context.WithValue(req.Context(), forwardKey{}, &forward{path: path})
+	p.reverse.ServeHTTP(w, req.WithContext(ctx))
+}
+
+// pick chooses the upstream for the next attempt at a request, reserving a slot in its circuit breaker.
+// Returns nil if no upstream is available.
+func (p *Proxy) pick(req *http.Request) *Upstream {
+	// A half-open circuit may refuse the pick if it is out of trial slots, so try a few times
+	for range len(p.balancer.Upstreams()) {
+		upstream := p.balancer.Next(req)
+		if upstream == nil {
+			return nil
+		}
+		if upstream.breaker.allow() {
+			return upstream
+		}
+	}
+	return nil
+}
+
+// report records the outcome of a request to an upstream for health checks and its circuit breaker.
+// A nil error means the request succeeded.
+func (p *Proxy) report(upstream *Upstream, err error) {
+	// A refused connection may mean a resolved upstream has moved, e.g. a service was rebuilt
+	if upstream.resolver != nil && err != nil && errorKind(err) == RetryConnect {
+		upstream.resolver.Invalidate()
+	}
+
+	upstream.reportRequest(err, p.options.Health)
+	upstream.breaker.report(upstream, err != nil)
+}
+
+// reportError records a failed request to an upstream. Errors caused by the client going away, like a user
+// leaving a slow page, say nothing about the upstream, so they don't count towards passive health checks
+// or its circuit breaker.
+func (p *Proxy) reportError(req *http.Request, upstream *Upstream, err error) {
+	if req.Context().Err() != nil || errors.Is(err, context.Canceled) {
+		upstream.breaker.release()
+		return
+	}
+	p.report(upstream, err)
+}
+
+// rewrite prepares the outgoing request. The upstream is filled in by the transport for each attempt.
+func (p *Proxy) rewrite(pr *httputil.ProxyRequest) {
+	// Rewrite drops the raw query, so copy it over from the original request
+	pr.Out.URL.RawQuery = pr.In.URL.RawQuery
+
+	p.options.Forwarded.setForwardedHeaders(pr.In, pr.Out.Header)
+	p.options.Rewrite.rewriteRequest(pr.Out)
+}
+
+// modifyResponse is called with the upstream response before it is relayed to the client.
+func (p *Proxy) modifyResponse(resp *http.Response) error {
+	f := resp.Request.Context().Value(forwardKey{}).(*forward)
+	return p.options.Rewrite.rewriteResponse(resp, f.upstream)
+}
+
+// handleError is called when no upstream produced a response.
+func (p *Proxy) handleError(w http.ResponseWriter, req *http.Request, err error) {
+	f := req.Context().Value(forwardKey{}).(*forward)
+	p.respondError(w, req, f.upstream, err)
+}
+
+// respondError logs an upstream error and responds with the matching status code.
+func (p *Proxy) respondError(w http.ResponseWriter, req *http.Request, upstream *Upstream, err error) {
+	logger := log.With().Str("path", req.URL.Path).Logger()
+	if upstream != nil {
+		logger = logger.With().Stringer("upstream", upstream).Logger()
+	}
+
+	// The client went away, so there is nobody to respond to
+	if req.Context().Err() == context.Canceled {
+		logger.Debug().Msg("Client cancelled proxy request")
+		return
+	}
+
+	status := StatusForError(err)
+	logger.Warn().Err(err).Int("status", status).Msg("Error forwarding request")
+	if IsGRPCRequest(req) {
+		WriteGRPCError(w, grpcCodeForError(err), fmt.Sprintf("Error forwarding request: %v", err))
+		return
+	}
+	p.options.WriteError(w, req, status, fmt.Sprintf("Error forwarding request: %v", err))
+}
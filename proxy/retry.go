@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"slices"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultRetryBackoff      = 50 * time.Millisecond
+	defaultRetryMaxBackoff   = time.Second
+	defaultRetryMaxBodyBytes = 64 * 1024
+)
+
+// Kinds of errors that can be retried
+const (
+	// The upstream couldn't be connected to, so the request was never sent
+	RetryConnect = "connect"
+	// The attempt timed out
+	RetryTimeout = "timeout"
+	// The upstream closed or reset the connection before responding
+	RetryReset = "reset"
+)
+
+// RetryOptions configures retrying failed requests, each time on a freshly picked upstream.
+type RetryOptions struct {
+	// Total number of attempts, including the first one. Retries are disabled if this is 1 or less.
+	MaxAttempts int
+	// Upstream response statuses that are retried, defaults to 502, 503 and 504.
+	RetryOn []int
+	// Kinds of errors that are retried (RetryConnect, RetryTimeout, RetryReset), defaults to all of them.
+	RetryErrors []string
+	// Only idempotent methods (GET, HEAD, OPTIONS, TRACE, PUT, DELETE) are retried unless this is set.
+	RetryNonIdempotent bool
+	// Time limit for each attempt to get the response headers. The body isn't limited, so long downloads
+	// and streamed responses aren't cut off. Zero means attempts are only limited by the client request.
+	PerTryTimeout time.Duration
+	// Delay before the first retry, doubling for each further retry up to MaxBackoff.
+	// A random jitter of up to the full delay is applied. Defaults to 50ms and 1s.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Request bodies up to this size are buffered so they can be replayed.
+	// Requests with larger bodies are not retried. Defaults to 64KiB.
+	MaxBodyBytes int64
+}
+
+func (o RetryOptions) withDefaults() RetryOptions {
+	if len(o.RetryOn) == 0 {
+		o.RetryOn = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+	}
+	if len(o.RetryErrors) == 0 {
+		o.RetryErrors = []string{RetryConnect, RetryTimeout, RetryReset}
+	}
+	if o.Backoff <= 0 {
+		o.Backoff = defaultRetryBackoff
+	}
+	if o.MaxBackoff <= 0 {
+		o.MaxBackoff = defaultRetryMaxBackoff
+	}
+	if o.MaxBodyBytes <= 0 {
+		o.MaxBodyBytes = defaultRetryMaxBodyBytes
+	}
+	return o
+}
+
+// enabled checks if the request can be retried at all, based on its method.
+func (o RetryOptions) enabled(req *http.Request) bool {
+	if o.MaxAttempts <= 1 {
+		return false
+	}
+	return o.RetryNonIdempotent || isIdempotent(req.Method)
+}
+
+// retryableError checks if a failed attempt should be retried.
+func (o RetryOptions) retryableError(err error) bool {
+	kind := errorKind(err)
+	return kind != "" && slices.Contains(o.RetryErrors, kind)
+}
+
+// retryableStatus checks if an upstream response should be retried.
+func (o RetryOptions) retryableStatus(status int) bool {
+	return slices.Contains(o.RetryOn, status)
+}
+
+// backoff returns the delay before the given retry (starting at 1), with full jitter.
+func (o RetryOptions) backoff(retry int) time.Duration {
+	delay := o.Backoff
+	for i := 1; i < retry && delay < o.MaxBackoff; i++ {
+		delay *= 2
+	}
+	delay = min(delay, o.MaxBackoff)
+	return time.Duration(rand.Int64N(int64(delay) + 1))
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
+
+// errorKind classifies an error from an attempt into one of the retryable kinds,
+// or returns an empty string if it isn't retryable.
+func errorKind(err error) string {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return RetryConnect
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return RetryTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return RetryTimeout
+	}
+
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return RetryReset
+	}
+
+	return ""
+}
+
+// sleep waits for the given duration, returning early with an error if ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPerTryTimeoutOnlyCoversHeaders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		// Stream the body for longer than the per-try timeout
+		for range 4 {
+			io.WriteString(w, "chunk;")
+			w.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+		}
+	}))
+	t.Cleanup(server.Close)
+	upstream, err := NewUpstream(server.URL, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := newTestProxy(t, upstream, Options{Retry: RetryOptions{MaxAttempts: 1, PerTryTimeout: 100 * time.Millisecond}})
+
+	resp, err := http.Get(proxy.URL + "/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(body) != strings.Repeat("chunk;", 4) {
+		t.Errorf("streamed response: got %q, %v", body, err)
+	}
+
+	resp, err = http.Get(proxy.URL + "/slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("slow response headers: got %d, want 504", resp.StatusCode)
+	}
+}
@@ -0,0 +1,275 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const defaultRewriteMaxBodyBytes = 10 * 1024 * 1024
+
+// Content types whose bodies are rewritten if no others are configured.
+// A trailing '*' matches any subtype.
+var defaultRewriteContentTypes = []string{"text/*", "application/javascript", "application/json", "application/xml"}
+
+// HeaderRules modifies a set of headers. Headers are removed first, then set, then added.
+type HeaderRules struct {
+	Set    map[string]string
+	Add    map[string]string
+	Remove []string
+}
+
+func (hr HeaderRules) apply(h http.Header) {
+	for _, key := range hr.Remove {
+		h.Del(key)
+	}
+	for key, value := range hr.Set {
+		h.Set(key, value)
+	}
+	for key, value := range hr.Add {
+		h.Add(key, value)
+	}
+}
+
+// BodyRule replaces all matches of a regular expression in a response body.
+// The replacement can refer to capture groups, e.g. "$1".
+type BodyRule struct {
+	Pattern *regexp.Regexp
+	Replace string
+}
+
+// CompileBodyRule compiles a body rule from a regular expression string.
+func CompileBodyRule(pattern, replace string) (BodyRule, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return BodyRule{}, fmt.Errorf("invalid body rewrite pattern '%s': %w", pattern, err)
+	}
+	return BodyRule{Pattern: re, Replace: replace}, nil
+}
+
+// RewriteOptions modifies requests on their way to the upstream, and responses on their way back.
+type RewriteOptions struct {
+	Request  HeaderRules
+	Response HeaderRules
+
+	// MapPath maps a path on the upstream to the public path it is served under, if there is one.
+	// It is used to rewrite Location headers and cookie paths, and is required for either to work.
+	MapPath func(upstreamPath string) (string, bool)
+	// Rewrite Location headers pointing at the upstream to the public path.
+	Location bool
+	// Rewrite the Path attribute of cookies set by the upstream to the public path.
+	CookiePath bool
+	// Replaces the Domain attribute of cookies set by the upstream, keyed by the upstream domain.
+	// Mapping to an empty string removes the attribute, so the cookie belongs to the public host.
+	CookieDomain map[string]string
+
+	// Rules applied to response bodies with one of BodyContentTypes (defaults to common text types).
+	// Bodies larger than MaxBodyBytes (default 10MiB) are passed through unchanged.
+	Body             []BodyRule
+	BodyContentTypes []string
+	MaxBodyBytes     int64
+}
+
+func (o RewriteOptions) withDefaults() RewriteOptions {
+	if len(o.BodyContentTypes) == 0 {
+		o.BodyContentTypes = defaultRewriteContentTypes
+	}
+	if o.MaxBodyBytes <= 0 {
+		o.MaxBodyBytes = defaultRewriteMaxBodyBytes
+	}
+	return o
+}
+
+// rewriteRequest applies the request rules to an outgoing request.
+func (o RewriteOptions) rewriteRequest(out *http.Request) {
+	o.Request.apply(out.Header)
+
+	// Body rules need to see the body as plain text, so don't ask for it compressed.
+	// The transport still negotiates compression itself, and decompresses transparently.
+	if len(o.Body) > 0 {
+		out.Header.Del("Accept-Encoding")
+	}
+}
+
+// rewriteResponse applies the response rules to a response from the given upstream.
+func (o RewriteOptions) rewriteResponse(resp *http.Response, upstream *Upstream) error {
+	o.Response.apply(resp.Header)
+
+	if o.Location {
+		if location := resp.Header.Get("Location"); location != "" {
+			resp.Header.Set("Location", o.rewriteLocation(location, upstream))
+		}
+	}
+
+	if o.CookiePath || len(o.CookieDomain) > 0 {
+		cookies := resp.Header.Values("Set-Cookie")
+		for i, cookie := range cookies {
+			cookies[i] = o.rewriteCookie(cookie, upstream)
+		}
+	}
+
+	if len(o.Body) > 0 && o.rewritesContentType(resp.Header.Get("Content-Type")) {
+		return o.rewriteBody(resp)
+	}
+	return nil
+}
+
+// mapUpstreamPath maps a path on the upstream to its public path.
+func (o RewriteOptions) mapUpstreamPath(path string, upstream *Upstream) (string, bool) {
+	if o.MapPath == nil {
+		return "", false
+	}
+
+	target, err := upstream.resolve()
+	if err != nil {
+		return "", false
+	}
+
+	// Paths on the upstream are relative to the path of its target
+	if base := strings.TrimSuffix(targetPath(target), "/"); base != "" {
+		if path != base && !strings.HasPrefix(path, base+"/") {
+			return "", false
+		}
+		path = strings.TrimPrefix(path, base)
+		if path == "" {
+			path = "/"
+		}
+	}
+
+	return o.MapPath(path)
+}
+
+// rewriteLocation maps a redirect to the upstream onto the public path. Redirects elsewhere are kept.
+func (o RewriteOptions) rewriteLocation(location string, upstream *Upstream) string {
+	target, err := url.Parse(location)
+	if err != nil {
+		return location
+	}
+
+	// Absolute redirects are only rewritten if they point to the upstream itself
+	if target.Host != "" {
+		upstreamTarget, err := upstream.resolve()
+		if err != nil || !strings.EqualFold(target.Host, upstreamTarget.Host) {
+			return location
+		}
+	}
+	if target.Host == "" && !strings.HasPrefix(target.Path, "/") {
+		return location
+	}
+
+	path, ok := o.mapUpstreamPath(target.Path, upstream)
+	if !ok {
+		return location
+	}
+
+	// Redirects are made relative, so they resolve against the public host
+	rewritten := url.URL{
+		Path:     path,
+		RawQuery: target.RawQuery,
+		Fragment: target.Fragment,
+	}
+	return rewritten.String()
+}
+
+// rewriteCookie rewrites the Path and Domain attributes of a Set-Cookie header value.
+func (o RewriteOptions) rewriteCookie(cookie string, upstream *Upstream) string {
+	parts := strings.Split(cookie, ";")
+
+	// The first part is the name and value, the rest are attributes
+	kept := parts[:1]
+	for _, part := range parts[1:] {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+
+		switch {
+		case o.CookiePath && strings.EqualFold(name, "path"):
+			if path, ok := o.mapUpstreamPath(value, upstream); ok {
+				part = " Path=" + path
+			}
+
+		case strings.EqualFold(name, "domain"):
+			if replacement, ok := o.lookupCookieDomain(value); ok {
+				if replacement == "" {
+					continue
+				}
+				part = " Domain=" + replacement
+			}
+		}
+		kept = append(kept, part)
+	}
+
+	return strings.Join(kept, ";")
+}
+
+func (o RewriteOptions) lookupCookieDomain(domain string) (string, bool) {
+	domain = strings.TrimPrefix(domain, ".")
+	for from, to := range o.CookieDomain {
+		if strings.EqualFold(strings.TrimPrefix(from, "."), domain) {
+			return to, true
+		}
+	}
+	return "", false
+}
+
+func (o RewriteOptions) rewritesContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	// Event streams never end, so they can't be buffered
+	if mediaType == "text/event-stream" {
+		return false
+	}
+
+	for _, allowed := range o.BodyContentTypes {
+		if prefix, ok := strings.CutSuffix(allowed, "*"); ok {
+			if strings.HasPrefix(mediaType, prefix) {
+				return true
+			}
+		} else if mediaType == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteBody applies the body rules to the response body, if it is small enough and not compressed.
+func (o RewriteOptions) rewriteBody(resp *http.Response) error {
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return nil
+	}
+	if resp.ContentLength > o.MaxBodyBytes {
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, o.MaxBodyBytes+1))
+	if err != nil {
+		return fmt.Errorf("error reading response body: %w", err)
+	}
+
+	// Too large after all, so send what we read followed by the rest unchanged
+	if int64(len(body)) > o.MaxBodyBytes {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return nil
+	}
+	resp.Body.Close()
+
+	for _, rule := range o.Body {
+		body = rule.Pattern.ReplaceAll(body, []byte(rule.Replace))
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.Header.Del("Transfer-Encoding")
+	return nil
+}
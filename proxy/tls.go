@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// TLSOptions configures how the proxy connects to HTTPS upstreams.
+type TLSOptions struct {
+	// PEM bundle of CAs trusted for upstream certificates, instead of the system roots
+	CAFile string
+	// Client certificate and key presented to upstreams (mTLS)
+	CertFile string
+	KeyFile  string
+	// Overrides the name used for SNI and certificate verification, which defaults to the upstream host
+	ServerName string
+	// Minimum TLS version, e.g. tls.VersionTLS12. Defaults to TLS 1.2.
+	MinVersion uint16
+	// Skips certificate verification. Only meant for local development.
+	Insecure bool
+}
+
+// Config builds a tls.Config from the options, loading the CA bundle and client certificate.
+func (o TLSOptions) Config() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         o.ServerName,
+		MinVersion:         o.MinVersion,
+		InsecureSkipVerify: o.Insecure,
+	}
+	if config.MinVersion == 0 {
+		config.MinVersion = tls.VersionTLS12
+	}
+
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file '%s'", o.CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if o.CertFile != "" || o.KeyFile != "" {
+		if o.CertFile == "" || o.KeyFile == "" {
+			return nil, fmt.Errorf("client certificates need both a cert file and a key file")
+		}
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// ParseTLSVersion parses a TLS version, "1.2" or "1.3". TLS 1.0 and 1.1 are deprecated, so they are rejected.
+func ParseTLSVersion(version string) (uint16, error) {
+	switch strings.TrimPrefix(strings.ToLower(version), "tls") {
+	case "":
+		return 0, nil
+	case "1.0", "1", "1.1":
+		return 0, fmt.Errorf("TLS version '%s' is deprecated, use 1.2 or 1.3", version)
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unknown TLS version '%s'", version)
+	}
+}
+
+// TransportOptions tunes the connections made to upstreams. Zero values keep the defaults of the shared transport.
+type TransportOptions struct {
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+
+	DisableHTTP2 bool
+	// Speak only HTTP/2 to upstreams: cleartext (h2c) for http:// upstreams, and negotiated through TLS for https://.
+	// Needed for gRPC, which doesn't work over HTTP/1.
+	H2C bool
+	TLS TLSOptions
+}
+
+// NewTransport creates a transport for upstream requests. Transports keep a pool of idle connections,
+// so a transport should be shared by every proxy using the same options.
+func NewTransport(options TransportOptions) (*http.Transport, error) {
+	transport := defaultTransport.Clone()
+
+	if options.MaxIdleConns > 0 {
+		transport.MaxIdleConns = options.MaxIdleConns
+	}
+	if options.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = options.MaxIdleConnsPerHost
+	}
+	if options.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = options.IdleConnTimeout
+	}
+	if options.DialTimeout > 0 {
+		transport.DialContext = dialUnixSockets((&net.Dialer{
+			Timeout:   options.DialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext)
+	}
+	if options.TLSHandshakeTimeout > 0 {
+		transport.TLSHandshakeTimeout = options.TLSHandshakeTimeout
+	}
+	transport.ResponseHeaderTimeout = options.ResponseHeaderTimeout
+
+	tlsConfig, err := options.TLS.Config()
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	if options.H2C && options.DisableHTTP2 {
+		return nil, fmt.Errorf("h2c needs HTTP/2, which is disabled")
+	}
+	if options.H2C {
+		EnableH2C(transport)
+	}
+
+	// A non-nil, empty TLSNextProto is how http.Transport is told not to use HTTP/2
+	if options.DisableHTTP2 {
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+
+	return transport, nil
+}
+
+// EnableH2C makes a transport speak only HTTP/2: cleartext (h2c) to http:// upstreams, and through TLS to https://.
+func EnableH2C(transport *http.Transport) {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+	transport.Protocols = protocols
+	transport.TLSNextProto = nil
+	transport.ForceAttemptHTTP2 = true
+}
@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ErrNoUpstream is returned when every upstream is unhealthy, ejected, or has an open circuit.
+var ErrNoUpstream = errors.New("no upstream available")
+
+// upstreamTransport sends proxied requests to an upstream picked by the balancer.
+// Failed attempts are retried on a newly picked upstream, according to the retry policy.
+type upstreamTransport struct {
+	proxy *Proxy
+	base  http.RoundTripper
+}
+
+func (t *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	f := req.Context().Value(forwardKey{}).(*forward)
+	retry := t.proxy.options.Retry
+
+	attempts := 1
+	var body []byte
+	if retry.enabled(req) {
+		attempts = retry.MaxAttempts
+
+		// Buffer the body so it can be replayed; if it is too large we can only try once
+		if req.Body != nil && req.Body != http.NoBody {
+			buffered, rest, err := bufferBody(req.Body, retry.MaxBodyBytes)
+			if err != nil {
+				return nil, fmt.Errorf("error reading request body: %w", err)
+			}
+			if rest != nil {
+				attempts = 1
+				req.Body = rest
+			} else {
+				body = buffered
+			}
+		}
+	}
+
+	for attempt := 1; ; attempt++ {
+		upstream := t.proxy.pick(req)
+		if upstream == nil {
+			return nil, ErrNoUpstream
+		}
+		f.upstream = upstream
+
+		resp, err := t.attempt(req, f.path, upstream, body)
+
+		last := attempt >= attempts || req.Context().Err() != nil
+		if err != nil {
+			if last || !retry.retryableError(err) {
+				return nil, err
+			}
+			log.Debug().Err(err).Stringer("upstream", upstream).Int("attempt", attempt).Msg("Retrying proxy request")
+		} else {
+			if last || !retry.retryableStatus(resp.StatusCode) {
+				return resp, nil
+			}
+			log.Debug().Int("status", resp.StatusCode).Stringer("upstream", upstream).Int("attempt", attempt).Msg("Retrying proxy request")
+			resp.Body.Close()
+		}
+
+		if err := sleep(req.Context(), retry.backoff(attempt)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// attempt sends a single try of the request to the given upstream.
+func (t *upstreamTransport) attempt(req *http.Request, path string, upstream *Upstream, body []byte) (*http.Response, error) {
+	// The per-try timeout only covers waiting for the response headers, so long downloads and streamed
+	// responses aren't cut off. The context is cancelled once the response has been relayed.
+	ctx, cancel := context.WithCancel(req.Context())
+	timeout := t.proxy.options.Retry.PerTryTimeout
+	stopTimer := func() bool { return true }
+	if timeout > 0 {
+		stopTimer = time.AfterFunc(timeout, cancel).Stop
+	}
+
+	target, err := upstream.requestURL(req, path)
+	if err != nil {
+		// Nothing was sent, so give back the circuit breaker slot reserved by pick
+		upstream.breaker.release()
+		cancel()
+		return nil, err
+	}
+
+	out := req.Clone(ctx)
+	out.URL = target
+	out.Host = hostHeader(target)
+	if body != nil {
+		out.Body = io.NopCloser(bytes.NewReader(body))
+		out.ContentLength = int64(len(body))
+	}
+
+	release := upstream.acquire()
+	resp, err := t.base.RoundTrip(out)
+	if !stopTimer() && req.Context().Err() == nil {
+		if err == nil {
+			resp.Body.Close()
+		}
+		err = fmt.Errorf("no response within the per-try timeout of %s: %w", timeout, context.DeadlineExceeded)
+	}
+	if err != nil {
+		t.proxy.reportError(req, upstream, err)
+		cancel()
+		release()
+		return nil, err
+	}
+
+	if isFailureStatus(resp.StatusCode) {
+		t.proxy.report(upstream, fmt.Errorf("upstream responded with status %d", resp.StatusCode))
+	} else {
+		t.proxy.report(upstream, nil)
+	}
+
+	// The attempt is over once the response has been relayed
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: func() {
+		cancel()
+		release()
+	}}
+	return resp, nil
+}
+
+// bufferBody reads up to limit bytes of body. If the body is longer, or reading it fails, it returns a reader
+// that replays what was read followed by the rest of the body instead, along with the error.
+func bufferBody(body io.ReadCloser, limit int64) ([]byte, io.ReadCloser, error) {
+	buffered, err := io.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil || int64(len(buffered)) > limit {
+		rest := struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buffered), body), body}
+		return nil, rest, err
+	}
+
+	body.Close()
+	return buffered, nil, nil
+}
+
+// releaseBody runs release once the response body is closed.
+type releaseBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
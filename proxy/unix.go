@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Requests to unix socket upstreams are sent to a placeholder host, which the transport dials through the
+// socket instead. Each socket has its own host, so the transport pools connections per socket.
+const unixHostSuffix = ".unix.localhost"
+
+// Maps placeholder hosts to their socket paths
+var unixSockets sync.Map
+
+// unixHost returns the placeholder host for a socket path.
+func unixHost(socket string) string {
+	h := fnv.New64a()
+	h.Write([]byte(socket))
+	host := fmt.Sprintf("%x%s", h.Sum64(), unixHostSuffix)
+	unixSockets.Store(host, socket)
+	return host
+}
+
+// unixSocket returns the socket path for a placeholder host, which may include a port.
+func unixSocket(host string) (string, bool) {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	if !strings.HasSuffix(host, unixHostSuffix) {
+		return "", false
+	}
+	socket, ok := unixSockets.Load(host)
+	if !ok {
+		return "", false
+	}
+	return socket.(string), true
+}
+
+// dialUnixSockets wraps a dial function, so placeholder hosts are dialed through their unix socket.
+func dialUnixSockets(dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		if socket, ok := unixSocket(address); ok {
+			return dial(ctx, "unix", socket)
+		}
+		return dial(ctx, network, address)
+	}
+}
+
+// proxyFromEnvironment is http.ProxyFromEnvironment, except that unix sockets are never proxied.
+func proxyFromEnvironment(req *http.Request) (*url.URL, error) {
+	if _, ok := unixSocket(req.URL.Host); ok {
+		return nil, nil
+	}
+	return http.ProxyFromEnvironment(req)
+}
+
+// targetURL builds the URL for a path on an upstream target, prefixed with the target's path.
+// Unix socket targets (unix:///run/app.sock) have no path of their own, and get a placeholder host.
+func targetURL(target *url.URL, path string) *url.URL {
+	if target.Scheme == "unix" {
+		return &url.URL{
+			Scheme: "http",
+			Host:   unixHost(target.Path),
+			Path:   path,
+		}
+	}
+
+	return &url.URL{
+		Scheme: target.Scheme,
+		Host:   target.Host,
+		Path:   target.Path + path,
+	}
+}
+
+// targetPath returns the path that requests to a target are prefixed with.
+func targetPath(target *url.URL) string {
+	if target.Scheme == "unix" {
+		return ""
+	}
+	return target.Path
+}
+
+// hostHeader returns the Host header for a request to an upstream URL. Unix socket upstreams
+// are sent "localhost", rather than their placeholder host. Otherwise the URL host is used.
+func hostHeader(upstreamURL *url.URL) string {
+	if _, ok := unixSocket(upstreamURL.Host); ok {
+		return "localhost"
+	}
+	return ""
+}
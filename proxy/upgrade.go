@@ -0,0 +1,330 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const defaultHandshakeTimeout = 10 * time.Second
+
+// UpgradeOptions configures how Upgrade requests (e.g. WebSockets) are tunneled to the upstream.
+type UpgradeOptions struct {
+	// Disabled ignores the Upgrade header and forwards the request as a regular HTTP request.
+	Disabled bool
+
+	// IdleTimeout closes the tunnel once no data has passed in either direction for this long.
+	// Zero means tunnels are never closed for being idle.
+	IdleTimeout time.Duration
+
+	// HandshakeTimeout limits connecting to the upstream and receiving its handshake response.
+	// Defaults to 10 seconds.
+	HandshakeTimeout time.Duration
+}
+
+// Headers that only apply to a single connection, and must not be forwarded (RFC 9110, section 7.6.1).
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// isUpgradeRequest checks if the client is asking to switch protocols.
+func isUpgradeRequest(req *http.Request) bool {
+	return req.Header.Get("Upgrade") != "" && headerHasToken(req.Header, "Connection", "upgrade")
+}
+
+// headerHasToken checks if any of the comma separated values of a header match token (case-insensitive).
+func headerHasToken(h http.Header, key, token string) bool {
+	for _, value := range h.Values(key) {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// removeHopHeaders removes hop-by-hop headers, including any listed in the Connection header.
+func removeHopHeaders(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				h.Del(v)
+			}
+		}
+	}
+	for _, key := range hopHeaders {
+		h.Del(key)
+	}
+}
+
+// removeUpgradeHeaders strips the headers that ask for a protocol switch.
+func removeUpgradeHeaders(h http.Header) {
+	h.Del("Upgrade")
+	h.Del("Connection")
+}
+
+// forwardUpgrade tunnels an Upgrade request to the upstream. The handshake is forwarded as-is,
+// and if the upstream switches protocols the client connection is hijacked and spliced to the upstream.
+func (p *Proxy) forwardUpgrade(w http.ResponseWriter, req *http.Request, path string) {
+	upgradeType := req.Header.Get("Upgrade")
+
+	upstream := p.pick(req)
+	if upstream == nil {
+		p.respondError(w, req, nil, ErrNoUpstream)
+		return
+	}
+	defer upstream.acquire()()
+
+	timeout := p.options.Upgrade.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = defaultHandshakeTimeout
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	defer cancel()
+
+	// Build the outgoing handshake; only the upgrade itself survives the hop
+	target, err := upstream.requestURL(req, path)
+	if err != nil {
+		// Nothing was sent, so give back the circuit breaker slot reserved by pick
+		upstream.breaker.release()
+		p.respondError(w, req, upstream, err)
+		return
+	}
+
+	outReq := req.Clone(ctx)
+	outReq.URL = target
+	outReq.Host = outReq.URL.Host
+	if host := hostHeader(target); host != "" {
+		outReq.Host = host
+	}
+	outReq.RequestURI = ""
+	removeHopHeaders(outReq.Header)
+	outReq.Header.Set("Connection", "Upgrade")
+	outReq.Header.Set("Upgrade", upgradeType)
+	p.options.Forwarded.setForwardedHeaders(req, outReq.Header)
+	p.options.Rewrite.Request.apply(outReq.Header)
+
+	upstreamConn, err := p.dial(ctx, target)
+	if err != nil {
+		p.reportError(req, upstream, err)
+		p.respondError(w, req, upstream, err)
+		return
+	}
+
+	// Deadlines bound the handshake, since conn reads and writes don't respect ctx
+	if deadline, ok := ctx.Deadline(); ok {
+		upstreamConn.SetDeadline(deadline)
+	}
+
+	if err := outReq.Write(upstreamConn); err != nil {
+		upstreamConn.Close()
+		p.reportError(req, upstream, err)
+		p.respondError(w, req, upstream, err)
+		return
+	}
+
+	upstreamReader := bufio.NewReader(upstreamConn)
+	resp, err := http.ReadResponse(upstreamReader, outReq)
+	if err != nil {
+		upstreamConn.Close()
+		p.reportError(req, upstream, err)
+		p.respondError(w, req, upstream, err)
+		return
+	}
+	p.report(upstream, nil)
+
+	// The upstream refused to switch protocols, so relay its response as a normal one
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer upstreamConn.Close()
+		defer resp.Body.Close()
+
+		// The handshake deadline would cut off a large body, so only the client going away ends the relay
+		upstreamConn.SetDeadline(time.Time{})
+		stop := context.AfterFunc(req.Context(), func() { upstreamConn.Close() })
+		defer stop()
+
+		removeHopHeaders(resp.Header)
+		if err := p.options.Rewrite.rewriteResponse(resp, upstream); err != nil {
+			p.respondError(w, req, upstream, err)
+			return
+		}
+		copyHeader(w.Header(), resp.Header)
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), upgradeType) {
+		upstreamConn.Close()
+		p.respondError(w, req, upstream, fmt.Errorf("upstream switched to protocol '%s', but client requested '%s'", resp.Header.Get("Upgrade"), upgradeType))
+		return
+	}
+
+	// Take over the client connection
+	clientConn, clientBuf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		upstreamConn.Close()
+		p.respondError(w, req, upstream, fmt.Errorf("unable to hijack client connection: %w", err))
+		return
+	}
+
+	// Clear handshake and server deadlines, the idle timeout takes over from here
+	upstreamConn.SetDeadline(time.Time{})
+	clientConn.SetDeadline(time.Time{})
+
+	// Send the upstream handshake response to the client
+	removeHopHeaders(resp.Header)
+	p.options.Rewrite.Response.apply(resp.Header)
+	resp.Header.Set("Connection", "Upgrade")
+	resp.Header.Set("Upgrade", upgradeType)
+	fmt.Fprintf(clientBuf, "HTTP/1.1 %s\r\n", resp.Status)
+	resp.Header.Write(clientBuf)
+	clientBuf.WriteString("\r\n")
+	if err := clientBuf.Flush(); err != nil {
+		clientConn.Close()
+		upstreamConn.Close()
+		log.Debug().Err(err).Stringer("upstream", upstream).Msg("Error writing upgrade response to client")
+		return
+	}
+
+	log.Debug().Stringer("upstream", upstream).Str("protocol", upgradeType).Str("path", req.URL.Path).Msg("Opened upgraded connection")
+	splice(clientConn, clientBuf.Reader, upstreamConn, upstreamReader, p.options.Upgrade.IdleTimeout)
+	log.Debug().Stringer("upstream", upstream).Str("protocol", upgradeType).Str("path", req.URL.Path).Msg("Closed upgraded connection")
+}
+
+// dial opens a raw connection to the host of an upstream URL, using TLS for https targets.
+// It connects the same way as the proxy's transport, including its TLS settings.
+func (p *Proxy) dial(ctx context.Context, target *url.URL) (net.Conn, error) {
+	address := target.Host
+	if target.Port() == "" {
+		if target.Scheme == "https" {
+			address = net.JoinHostPort(target.Hostname(), "443")
+		} else {
+			address = net.JoinHostPort(target.Hostname(), "80")
+		}
+	}
+
+	dialContext := p.transport.DialContext
+	if dialContext == nil {
+		dialContext = dialUnixSockets((&net.Dialer{}).DialContext)
+	}
+	conn, err := dialContext(ctx, "tcp", address)
+	if err != nil || target.Scheme != "https" {
+		return conn, err
+	}
+
+	var config *tls.Config
+	if p.transport.TLSClientConfig != nil {
+		config = p.transport.TLSClientConfig.Clone()
+	} else {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		config.ServerName = target.Hostname()
+	}
+	// The tunnel speaks HTTP/1.1, since upgrades don't exist in HTTP/2
+	config.NextProtos = []string{"http/1.1"}
+
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// copyHeader adds all values of src to dst.
+func copyHeader(dst, src http.Header) {
+	for key, values := range src {
+		for _, value := range values {
+			dst.Add(key, value)
+		}
+	}
+}
+
+// closeWriter is implemented by connections that support half-closing (TCP and TLS).
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// splice copies data in both directions until both sides are done.
+//
+// When one side finishes cleanly its write half is closed on the other connection, so the close
+// propagates while data still in flight the other way is delivered. If either direction fails,
+// or the tunnel is idle for longer than idleTimeout, both connections are closed.
+func splice(client net.Conn, clientReader io.Reader, upstream net.Conn, upstreamReader io.Reader, idleTimeout time.Duration) {
+	defer client.Close()
+	defer upstream.Close()
+
+	// Any read extends the deadline of both connections, so a tunnel that only carries
+	// data in one direction isn't considered idle
+	touch := func() {}
+	if idleTimeout > 0 {
+		touch = func() {
+			deadline := time.Now().Add(idleTimeout)
+			client.SetReadDeadline(deadline)
+			upstream.SetReadDeadline(deadline)
+		}
+		touch()
+	}
+
+	errc := make(chan error, 2)
+	pipe := func(dst net.Conn, src io.Reader) {
+		_, err := io.Copy(dst, &activityReader{src, touch})
+		if err == nil {
+			// Clean EOF: tell the other side we're done writing
+			if cw, ok := dst.(closeWriter); ok {
+				cw.CloseWrite()
+			} else {
+				dst.Close()
+			}
+		}
+		errc <- err
+	}
+	go pipe(upstream, clientReader)
+	go pipe(client, upstreamReader)
+
+	for range 2 {
+		if err := <-errc; err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Debug().Err(err).Msg("Upgraded connection closed with error")
+			}
+			// Closing both connections unblocks the other direction
+			client.Close()
+			upstream.Close()
+		}
+	}
+}
+
+// activityReader calls touch after every successful read.
+type activityReader struct {
+	io.Reader
+	touch func()
+}
+
+func (r *activityReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.touch()
+	}
+	return n, err
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+)
+
+// Upstream is a single server that a proxy can forward requests to.
+type Upstream struct {
+	target *url.URL
+	weight int
+
+	// Looks up the target of upstreams whose address can change, in which case target is nil
+	name     string
+	resolver Resolver
+
+	// Number of requests currently being forwarded to this upstream
+	active atomic.Int64
+
+	health  upstreamHealth
+	breaker circuitBreaker
+}
+
+// NewUpstream creates an upstream for the given target, e.g. "http://localhost:3000", or "unix:///run/app.sock"
+// for a unix socket. Any path on an HTTP target is prepended to forwarded paths. Weights below 1 are treated as 1.
+func NewUpstream(target string, weight int) (*Upstream, error) {
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream '%s': %w", target, err)
+	}
+	if targetURL.Scheme == "unix" {
+		if targetURL.Path == "" {
+			return nil, fmt.Errorf("unix socket upstream '%s' must include a socket path", target)
+		}
+	} else if targetURL.Scheme == "" || targetURL.Host == "" {
+		return nil, fmt.Errorf("upstream '%s' must include a scheme and host", target)
+	}
+
+	if weight < 1 {
+		weight = 1
+	}
+
+	return &Upstream{
+		target: targetURL,
+		weight: weight,
+	}, nil
+}
+
+// Resolver looks up the target of an upstream whose address can change, like a managed service.
+type Resolver interface {
+	// Resolve returns the current target. Errors wrapping ErrNoUpstream mean the upstream isn't ready yet.
+	Resolve() (*url.URL, error)
+	// Ready reports whether the upstream can currently be resolved. It is called for every request, so it should be cheap.
+	Ready() bool
+	// Invalidate drops any cached target, after the upstream refused a connection.
+	Invalidate()
+}
+
+// NewResolvedUpstream creates an upstream whose target is looked up by the resolver before each request.
+// The name identifies the upstream in logs and status reports. Weights below 1 are treated as 1.
+func NewResolvedUpstream(name string, resolver Resolver, weight int) *Upstream {
+	if weight < 1 {
+		weight = 1
+	}
+
+	return &Upstream{
+		name:     name,
+		resolver: resolver,
+		weight:   weight,
+	}
+}
+
+// String returns the upstream target, or the name of resolved upstreams.
+func (u *Upstream) String() string {
+	if u.resolver != nil {
+		return u.name
+	}
+	return u.target.String()
+}
+
+func (u *Upstream) Weight() int {
+	return u.weight
+}
+
+// ActiveRequests returns the number of requests currently being forwarded to this upstream.
+func (u *Upstream) ActiveRequests() int64 {
+	return u.active.Load()
+}
+
+// acquire marks the start of a request to this upstream; the returned function marks its end.
+func (u *Upstream) acquire() func() {
+	u.active.Add(1)
+	return func() { u.active.Add(-1) }
+}
+
+// ready reports whether the target of the upstream is known, which is always the case for static targets.
+func (u *Upstream) ready() bool {
+	return u.resolver == nil || u.resolver.Ready()
+}
+
+// resolve returns the current target of the upstream.
+func (u *Upstream) resolve() (*url.URL, error) {
+	if u.resolver == nil {
+		return u.target, nil
+	}
+
+	target, err := u.resolver.Resolve()
+	if err != nil {
+		return nil, fmt.Errorf("error resolving upstream %s: %w", u.name, err)
+	}
+	return target, nil
+}
+
+// requestURL builds the URL of a request to this upstream for the given path.
+// The query string of the incoming request is preserved.
+func (u *Upstream) requestURL(in *http.Request, path string) (*url.URL, error) {
+	target, err := u.resolve()
+	if err != nil {
+		return nil, err
+	}
+
+	out := targetURL(target, path)
+
+	switch {
+	case target.RawQuery == "":
+		out.RawQuery = in.URL.RawQuery
+	case in.URL.RawQuery == "":
+		out.RawQuery = target.RawQuery
+	default:
+		out.RawQuery = target.RawQuery + "&" + in.URL.RawQuery
+	}
+
+	return out, nil
+}
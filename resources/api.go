@@ -1,11 +1,17 @@
 package resources
 
 import (
+	"aspen/auth"
 	"aspen/config"
+	"aspen/proxy"
 	"aspen/router"
+	"aspen/utils"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"slices"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 )
@@ -40,7 +46,7 @@ func verifyTimestamp(p postParams, config *config.Config) error {
 // Adds API routes that allow querying and updating the router config.
 func (ur *RouterAPIResource) AddHandlers(path string, r *router.RouterInstance) error {
 	/*
-		 	* GET middleware: Array of strings
+		 	* GET middleware: Array of middleware JSONs
 			* GET routes: Array of route JSONs
 			* GET route(id): Route JSON corresponding to given id
 			* GET services: Array of service JSONs
@@ -49,15 +55,31 @@ func (ur *RouterAPIResource) AddHandlers(path string, r *router.RouterInstance)
 			* GET available_middleware: Array of all middleware strings
 			* GET available_resources: Array of resource type strings
 			* GET resource_params(type): Return params for the given resource type
+			* GET middleware_params(type): Return params for the given middleware type
+
+			* GET upstreams: Health and load of the upstreams of each proxy resource, keyed by resource id
+			* GET instances: Requests in flight on the active router instance, and on replaced instances still draining
+			* GET users: Array of users, with their roles but not their password hashes
+			* GET api_keys: Array of API keys, with their roles, expiry and last use but not their hashes
 
 			- Each POST request should also include a timestamp field to prevent replay attacks
-			* POST set_middleware(middleware): Sets middleware to be new array of strings
+			* POST set_middleware(middleware): Sets the global middleware chain
 			* POST add_route(route): Adds a new route
 			* POST delete_route(id): Deletes the route with the given id
 			* POST update_route(id, resource): Updates the route resource with the given id
 			* POST change_route(id, route): Changes the route path for the given id
 
+			* POST validate(config): Checks a whole config without applying it, returning its validation issues
+
+			* POST add_user(user): Adds a user with a username, password and roles
+			* POST remove_user(username): Removes the user with the given username
+			* POST change_password(username, password): Changes the password of the given user
+
+			* POST mint_api_key(key): Adds an API key with a name, roles and optional expiry, returning its secret once
+			* POST revoke_api_key(id): Removes the API key with the given id
+
 			* POST reload: Reloads the router config from disk
+			* POST purge_cache(id, prefix): Removes cached responses of a resource (or all if no id) for paths starting with prefix
 	*/
 	r.GET(path+"/middleware", ur.BaseResource, get_middleware)
 	r.GET(path+"/routes", ur.BaseResource, get_routes)
@@ -66,6 +88,12 @@ func (ur *RouterAPIResource) AddHandlers(path string, r *router.RouterInstance)
 	r.GET(path+"/available_middleware", ur.BaseResource, get_available_middleware)
 	r.GET(path+"/available_resources", ur.BaseResource, get_available_resources)
 	r.GET(path+"/resource_params/:type", ur.BaseResource, get_resource_params)
+	r.GET(path+"/middleware_params/:type", ur.BaseResource, get_middleware_params)
+
+	r.GET(path+"/upstreams", ur.BaseResource, get_upstreams(r))
+	r.GET(path+"/instances", ur.BaseResource, get_instances)
+	r.GET(path+"/users", ur.BaseResource, get_users)
+	r.GET(path+"/api_keys", ur.BaseResource, get_api_keys(r))
 
 	r.POST(path+"/set_middleware", ur.BaseResource, set_middleware)
 	r.POST(path+"/add_route", ur.BaseResource, add_route)
@@ -73,7 +101,17 @@ func (ur *RouterAPIResource) AddHandlers(path string, r *router.RouterInstance)
 	r.POST(path+"/update_route", ur.BaseResource, update_route)
 	r.POST(path+"/change_route", ur.BaseResource, change_route)
 
+	r.POST(path+"/validate", ur.BaseResource, validate)
+
+	r.POST(path+"/add_user", ur.BaseResource, add_user)
+	r.POST(path+"/remove_user", ur.BaseResource, remove_user)
+	r.POST(path+"/change_password", ur.BaseResource, change_password)
+
+	r.POST(path+"/mint_api_key", ur.BaseResource, mint_api_key)
+	r.POST(path+"/revoke_api_key", ur.BaseResource, revoke_api_key)
+
 	r.POST(path+"/reload", ur.BaseResource, reload)
+	r.POST(path+"/purge_cache", ur.BaseResource, purge_cache(r))
 
 	return nil
 }
@@ -180,6 +218,49 @@ func get_resource_params(w http.ResponseWriter, r *http.Request, p httprouter.Pa
 	w.Write(data)
 }
 
+func get_middleware_params(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	mwType := p.ByName("type")
+	middleware_params, err := config.GetMiddlewareParams(mwType)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get middleware params: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	data, err := json.Marshal(middleware_params)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to marshal JSON: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+}
+
+// upstreamReporter is implemented by resources that forward requests to upstreams.
+type upstreamReporter interface {
+	UpstreamStatus() []proxy.UpstreamStatus
+}
+
+// get_upstreams reports on the upstreams of the router instance serving the API,
+// rather than the config on disk, since health is only known for running resources.
+func get_upstreams(instance *router.RouterInstance) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		upstreams := make(map[string][]proxy.UpstreamStatus)
+		for _, resource := range instance.Resources() {
+			if reporter, ok := resource.(upstreamReporter); ok {
+				upstreams[resource.GetID()] = reporter.UpstreamStatus()
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		data, err := json.Marshal(upstreams)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to marshal JSON: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Write(data)
+	}
+}
+
 func set_middleware(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	var body struct {
 		Middleware []config.MiddlewareConfig `json:"middleware"`
@@ -201,7 +282,7 @@ func set_middleware(w http.ResponseWriter, r *http.Request, p httprouter.Params)
 	})
 
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to update middleware: %v", err), http.StatusInternalServerError)
+		writeConfigError(w, "Failed to update middleware", err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -235,7 +316,7 @@ func add_route(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	})
 
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to add route: %v", err), http.StatusInternalServerError)
+		writeConfigError(w, "Failed to add route", err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -269,7 +350,7 @@ func delete_route(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	})
 
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to delete route: %v", err), http.StatusInternalServerError)
+		writeConfigError(w, "Failed to delete route", err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -302,7 +383,7 @@ func update_route(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	})
 
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to update route: %v", err), http.StatusInternalServerError)
+		writeConfigError(w, "Failed to update route", err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -335,17 +416,78 @@ func change_route(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	})
 
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to change route: %v", err), http.StatusInternalServerError)
+		writeConfigError(w, "Failed to change route", err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 }
 
+// writeConfigError responds with the issues of an invalid config as JSON, so clients can point at the
+// offending routes. Other errors are plain text.
+func writeConfigError(w http.ResponseWriter, message string, err error) {
+	var report *router.ValidationReport
+	if !errors.As(err, &report) {
+		http.Error(w, fmt.Sprintf("%s: %v", message, err), http.StatusInternalServerError)
+		return
+	}
+
+	data, err := json.Marshal(struct {
+		Error  string                   `json:"error"`
+		Issues []router.ValidationIssue `json:"issues"`
+	}{message, report.Issues})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to marshal JSON: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	w.Write(data)
+}
+
+// validate checks a config without writing it, so no timestamp is needed.
+func validate(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var body struct {
+		Config config.Config `json:"config"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to decode body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	issues := []router.ValidationIssue{}
+	if err := body.Config.Validate(); err != nil {
+		var report *router.ValidationReport
+		if !errors.As(err, &report) {
+			http.Error(w, fmt.Sprintf("Failed to validate config: %v", err), http.StatusInternalServerError)
+			return
+		}
+		issues = report.Issues
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	data, err := json.Marshal(struct {
+		Valid  bool                     `json:"valid"`
+		Issues []router.ValidationIssue `json:"issues"`
+	}{len(issues) == 0, issues})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to marshal JSON: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+}
+
 func reload(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	// Load config
 	instance, err := config.ParseGlobalConfig()
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to parse global config: %v", err), http.StatusInternalServerError)
+		writeConfigError(w, "Failed to parse global config", err)
+		return
+	}
+
+	// Start services before swapping, so routes to them work right away
+	if err := instance.BuildAndStartServices(); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to start services: %v", err), http.StatusInternalServerError)
 		return
 	}
 
@@ -354,3 +496,350 @@ func reload(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 
 	w.WriteHeader(http.StatusOK)
 }
+
+func get_instances(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	data, err := json.Marshal(router.GlobalRouter.Status())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to marshal JSON: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+}
+
+func get_users(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	c, err := config.ReadGlobalConfig()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read global config: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	type user struct {
+		Username string   `json:"username"`
+		Roles    []string `json:"roles"`
+	}
+	users := make([]user, len(c.Users))
+	for i, u := range c.Users {
+		users[i] = user{Username: u.Username, Roles: u.Roles}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	data, err := json.Marshal(users)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to marshal JSON: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+}
+
+func add_user(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var body struct {
+		User struct {
+			Username string   `json:"username"`
+			Password string   `json:"password"`
+			Roles    []string `json:"roles"`
+		} `json:"user"`
+		postParams
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to decode body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// Hash before taking the config lock, since hashing is slow on purpose
+	hash, err := auth.HashPassword(body.User.Password)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to add user: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	err = config.UpdateGlobalConfig(func(c *config.Config) error {
+		if err := verifyTimestamp(body.postParams, c); err != nil {
+			return err
+		}
+
+		// Make sure the username is unique
+		for _, user := range c.Users {
+			if user.Username == body.User.Username {
+				return fmt.Errorf("user %s already exists", body.User.Username)
+			}
+		}
+
+		c.Users = append(c.Users, config.UserConfig{
+			Username:     body.User.Username,
+			PasswordHash: hash,
+			Roles:        body.User.Roles,
+		})
+		return nil
+	})
+
+	if err != nil {
+		writeConfigError(w, "Failed to add user", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func remove_user(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var body struct {
+		Username string `json:"username"`
+		postParams
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to decode body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	err := config.UpdateGlobalConfig(func(c *config.Config) error {
+		if err := verifyTimestamp(body.postParams, c); err != nil {
+			return err
+		}
+
+		for i, user := range c.Users {
+			if user.Username == body.Username {
+				c.Users = slices.Delete(c.Users, i, i+1)
+				return nil
+			}
+		}
+		// Removing a user that doesn't exist is not an error, just a no-op
+		return nil
+	})
+
+	if err != nil {
+		writeConfigError(w, "Failed to remove user", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func change_password(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var body struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		postParams
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to decode body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	hash, err := auth.HashPassword(body.Password)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to change password: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	err = config.UpdateGlobalConfig(func(c *config.Config) error {
+		if err := verifyTimestamp(body.postParams, c); err != nil {
+			return err
+		}
+
+		for i, user := range c.Users {
+			if user.Username == body.Username {
+				c.Users[i].PasswordHash = hash
+				return nil
+			}
+		}
+		return fmt.Errorf("user %s doesn't exist", body.Username)
+	})
+
+	if err != nil {
+		writeConfigError(w, "Failed to change password", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// get_api_keys lists the API keys of the config. Keys used since their last use was written
+// to the key use file show when the running instance last saw them.
+func get_api_keys(instance *router.RouterInstance) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		c, err := config.ReadGlobalConfig()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to read global config: %v", err), http.StatusInternalServerError)
+			return
+		}
+		used, err := config.ReadAPIKeyUse()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to read API key use: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		type apiKey struct {
+			Id       string     `json:"id"`
+			Name     string     `json:"name"`
+			Roles    []string   `json:"roles"`
+			Created  time.Time  `json:"created"`
+			Expires  *time.Time `json:"expires,omitempty"`
+			LastUsed *time.Time `json:"last_used,omitempty"`
+		}
+		keys := make([]apiKey, len(c.APIKeys))
+		for i, k := range c.APIKeys {
+			keys[i] = apiKey{Id: k.ID, Name: k.Name, Roles: k.Roles, Created: k.Created, Expires: k.Expires}
+			lastUsed, ok := used[k.ID]
+			if seen, seenOk := instance.APIKeys().LastUsed(k.ID); seenOk && seen.After(lastUsed) {
+				lastUsed, ok = seen, true
+			}
+			if ok {
+				keys[i].LastUsed = &lastUsed
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		data, err := json.Marshal(keys)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to marshal JSON: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Write(data)
+	}
+}
+
+func mint_api_key(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var body struct {
+		Key struct {
+			Name  string   `json:"name"`
+			Roles []string `json:"roles"`
+			// Either an expiry time, or how long the key lasts
+			Expires *time.Time     `json:"expires"`
+			TTL     utils.Duration `json:"ttl"`
+		} `json:"key"`
+		postParams
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to decode body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if body.Key.Name == "" {
+		http.Error(w, "Failed to mint API key: key has no name", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().UTC()
+	expires := body.Key.Expires
+	if body.Key.TTL > 0 {
+		ttlExpiry := now.Add(body.Key.TTL.Std())
+		expires = &ttlExpiry
+	}
+	if expires != nil && !expires.After(now) {
+		http.Error(w, "Failed to mint API key: expiry is in the past", http.StatusBadRequest)
+		return
+	}
+	var expiry time.Time
+	if expires != nil {
+		expiry = *expires
+	}
+	token, key := auth.GenerateAPIKey(body.Key.Name, body.Key.Roles, expiry)
+
+	err := config.UpdateGlobalConfig(func(c *config.Config) error {
+		if err := verifyTimestamp(body.postParams, c); err != nil {
+			return err
+		}
+
+		c.APIKeys = append(c.APIKeys, config.APIKeyConfig{
+			ID:      key.ID,
+			Name:    key.Name,
+			Hash:    key.Hash,
+			Roles:   key.Roles,
+			Created: now,
+			Expires: expires,
+		})
+		return nil
+	})
+
+	if err != nil {
+		writeConfigError(w, "Failed to mint API key", err)
+		return
+	}
+
+	// The secret is only ever shown here, since the config only keeps its hash
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(struct {
+		Id      string     `json:"id"`
+		Key     string     `json:"key"`
+		Expires *time.Time `json:"expires,omitempty"`
+	}{key.ID, token, expires})
+}
+
+func revoke_api_key(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var body struct {
+		Id string `json:"id"`
+		postParams
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to decode body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	err := config.UpdateGlobalConfig(func(c *config.Config) error {
+		if err := verifyTimestamp(body.postParams, c); err != nil {
+			return err
+		}
+
+		for i, key := range c.APIKeys {
+			if key.ID == body.Id {
+				c.APIKeys = slices.Delete(c.APIKeys, i, i+1)
+				return nil
+			}
+		}
+		return fmt.Errorf("API key %s doesn't exist", body.Id)
+	})
+
+	if err != nil {
+		writeConfigError(w, "Failed to revoke API key", err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// cachePurger is implemented by resources that can cache responses.
+type cachePurger interface {
+	PurgeCache(prefix string) int
+}
+
+// purge_cache removes cached responses from the router instance serving the API.
+// It doesn't change the config, so no timestamp is needed.
+func purge_cache(instance *router.RouterInstance) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		var body struct {
+			Id     string `json:"id"`
+			Prefix string `json:"prefix"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to decode body: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		resources := instance.Resources()
+		if body.Id != "" {
+			resource := instance.GetResource(body.Id)
+			if resource == nil {
+				http.Error(w, fmt.Sprintf("Resource with ID %s doesn't exist", body.Id), http.StatusNotFound)
+				return
+			}
+			resources = []router.Resource{resource}
+		}
+
+		purged := 0
+		for _, resource := range resources {
+			if purger, ok := resource.(cachePurger); ok {
+				purged += purger.PurgeCache(body.Prefix)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		data, err := json.Marshal(map[string]int{"purged": purged})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to marshal JSON: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Write(data)
+	}
+}
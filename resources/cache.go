@@ -0,0 +1,65 @@
+package resources
+
+import (
+	"aspen/cache"
+	"aspen/router"
+	"aspen/utils"
+	"net/http"
+)
+
+// CacheParams enables response caching for a route.
+type CacheParams struct {
+	Enabled bool
+
+	// Memory limit for the route (default 64MiB), and the largest response stored (default 8MiB)
+	MaxBytes      int64
+	MaxEntryBytes int64
+	// Freshness of responses without Cache-Control max-age or Expires
+	DefaultTTL utils.Duration
+
+	// Optional directory for a larger on-disk tier, which needs to be unique to the route
+	Dir          string
+	MaxDiskBytes int64
+}
+
+// cachedResource is embedded by resources that can cache their responses.
+type cachedResource struct {
+	cacheParams CacheParams
+
+	// Set once handlers are added, if caching is enabled
+	cache *cache.Cache
+}
+
+// initCache creates the cache for a route, if it is enabled. It is started and stopped with the router.
+func (cr *cachedResource) initCache(router *router.RouterInstance) {
+	if !cr.cacheParams.Enabled {
+		return
+	}
+
+	cr.cache = cache.New(cache.Options{
+		MaxBytes:      cr.cacheParams.MaxBytes,
+		MaxEntryBytes: cr.cacheParams.MaxEntryBytes,
+		DefaultTTL:    cr.cacheParams.DefaultTTL.Std(),
+		Dir:           cr.cacheParams.Dir,
+		MaxDiskBytes:  cr.cacheParams.MaxDiskBytes,
+	})
+	router.OnStart(cr.cache.Start)
+	router.OnStop(cr.cache.Stop)
+}
+
+// serveCached responds from the cache if it is enabled, and otherwise calls next directly.
+func (cr *cachedResource) serveCached(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+	if cr.cache == nil {
+		next(w, req)
+		return
+	}
+	cr.cache.Serve(w, req, next)
+}
+
+// PurgeCache removes cached responses for paths starting with prefix, returning how many were removed.
+func (cr *cachedResource) PurgeCache(prefix string) int {
+	if cr.cache == nil {
+		return 0
+	}
+	return cr.cache.Purge(prefix)
+}
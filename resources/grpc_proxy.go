@@ -0,0 +1,105 @@
+package resources
+
+import (
+	"aspen/proxy"
+	"aspen/router"
+	"aspen/utils"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// GRPCProxyResource forwards gRPC calls to upstreams over HTTP/2, picking the upstreams by method prefix.
+// Calls keep their full method path (e.g. "/pkg.Service/Method"), since gRPC servers route on it.
+type GRPCProxyResource struct {
+	services []*grpcService
+	router.BaseResource
+}
+
+type grpcService struct {
+	prefix string
+	*ProxyResource
+}
+
+type GRPCProxyParams struct {
+	Services []GRPCServiceParams
+}
+
+// GRPCServiceParams takes the same upstream parameters as a proxy resource.
+// Path and Methods are ignored, and calls go over HTTP/2: h2c for http:// upstreams, TLS for https://.
+type GRPCServiceParams struct {
+	// Method prefix, like "/pkg.Service/" or "/pkg.Service/Method". The longest matching prefix wins,
+	// and an empty prefix matches every call.
+	Prefix string
+	ProxyParams
+}
+
+func NewGRPCProxyResource(base router.BaseResource, params GRPCProxyParams) router.Resource {
+	services := make([]*grpcService, len(params.Services))
+	for i, service := range params.Services {
+		pr := NewProxyResource(base, service.ProxyParams).(*ProxyResource)
+		pr.h2c = true
+		services[i] = &grpcService{
+			prefix:        service.Prefix,
+			ProxyResource: pr,
+		}
+	}
+
+	// Longest prefixes first, so the first match is the most specific
+	sort.SliceStable(services, func(i, j int) bool {
+		return len(services[i].prefix) > len(services[j].prefix)
+	})
+
+	return &GRPCProxyResource{
+		services:     services,
+		BaseResource: base,
+	}
+}
+
+/*
+Adds a POST handler for every gRPC method under the given path.
+*/
+func (gr *GRPCProxyResource) AddHandlers(path string, r *router.RouterInstance) error {
+	if len(gr.services) == 0 {
+		return fmt.Errorf("grpc proxy needs at least one service")
+	}
+
+	route := strings.TrimSuffix(path, "/") + "/*method"
+	for _, service := range gr.services {
+		// Calls are forwarded with their own path, so the proxy path just has to fit the route
+		service.path = utils.ParsePath(route)
+
+		if _, err := service.newForwarder(route, r); err != nil {
+			return fmt.Errorf("error creating grpc service '%s': %w", service.prefix, err)
+		}
+	}
+
+	r.POST(route, gr.BaseResource, func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		if !proxy.IsGRPCRequest(req) {
+			router.Error(w, req, http.StatusUnsupportedMediaType, "Expected a gRPC request")
+			return
+		}
+
+		for _, service := range gr.services {
+			if strings.HasPrefix(req.URL.Path, service.prefix) {
+				service.forwarder.Forward(w, req, req.URL.Path)
+				return
+			}
+		}
+		proxy.WriteGRPCError(w, proxy.GRPCUnimplemented, fmt.Sprintf("No service for method %s", req.URL.Path))
+	})
+
+	return nil
+}
+
+// UpstreamStatus returns the state of the upstreams of every service.
+func (gr *GRPCProxyResource) UpstreamStatus() []proxy.UpstreamStatus {
+	var statuses []proxy.UpstreamStatus
+	for _, service := range gr.services {
+		statuses = append(statuses, service.UpstreamStatus()...)
+	}
+	return statuses
+}
@@ -0,0 +1,156 @@
+package resources
+
+import (
+	"aspen/auth"
+	"aspen/router"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/rs/zerolog/log"
+)
+
+// Login serves a login form that starts a session cookie for users of the config, and a logout path ending it.
+type Login struct {
+	title         string
+	defaultReturn string
+	router.BaseResource
+}
+
+type LoginParams struct {
+	// Heading of the login page. Defaults to "Sign in".
+	Title string
+	// Where users go after logging in, when they weren't sent to the login page from elsewhere. Defaults to "/".
+	DefaultReturn string
+}
+
+// returnParam is the query parameter holding where to go after logging in.
+const returnParam = "return"
+
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; display: flex; justify-content: center; margin-top: 10vh; }
+form { display: flex; flex-direction: column; gap: 0.5em; width: 18em; }
+.error { color: #b00020; }
+</style>
+</head>
+<body>
+<form method="post" action="{{.Action}}">
+<h1>{{.Title}}</h1>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+<label for="username">Username</label>
+<input id="username" name="username" autocomplete="username" value="{{.Username}}" required autofocus>
+<label for="password">Password</label>
+<input id="password" name="password" type="password" autocomplete="current-password" required>
+<input type="hidden" name="return" value="{{.Return}}">
+<button type="submit">Sign in</button>
+</form>
+</body>
+</html>
+`))
+
+type loginPageData struct {
+	Title    string
+	Action   string
+	Error    string
+	Username string
+	Return   string
+}
+
+func NewLogin(base router.BaseResource, params LoginParams) router.Resource {
+	if params.Title == "" {
+		params.Title = "Sign in"
+	}
+	if params.DefaultReturn == "" {
+		params.DefaultReturn = "/"
+	}
+
+	return &Login{
+		title:         params.Title,
+		defaultReturn: params.DefaultReturn,
+		BaseResource:  base,
+	}
+}
+
+/*
+Adds the login form at the path, which is posted back to the same path, and a logout handler for POSTs to path/logout.
+*/
+func (l *Login) AddHandlers(path string, r *router.RouterInstance) error {
+	r.GET(path, l.BaseResource, func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		l.render(w, req, http.StatusOK, loginPageData{Return: l.returnURL(req.URL.Query().Get(returnParam))})
+	})
+
+	r.POST(path, l.BaseResource, func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		sessions := r.Sessions()
+		if sessions == nil {
+			router.Error(w, req, http.StatusInternalServerError, "Sessions are not configured")
+			return
+		}
+		// Stop other sites from logging visitors in to an account of theirs
+		if !auth.SameOrigin(req) {
+			router.Error(w, req, http.StatusForbidden, "Cross-origin login is not allowed")
+			return
+		}
+
+		username := req.PostFormValue("username")
+		returnURL := l.returnURL(req.PostFormValue(returnParam))
+		user, ok := r.Users().Authenticate(username, req.PostFormValue("password"))
+		if !ok {
+			log.Info().Str("user", username).Str("request_id", router.RequestID(req)).Msg("Failed login")
+			l.render(w, req, http.StatusUnauthorized, loginPageData{
+				Error:    "Invalid username or password",
+				Username: username,
+				Return:   returnURL,
+			})
+			return
+		}
+
+		if err := sessions.Write(w, user); err != nil {
+			log.Error().Err(err).Str("user", username).Msg("Error starting session")
+			router.Error(w, req, http.StatusInternalServerError, "Unable to start session")
+			return
+		}
+		log.Info().Str("user", username).Str("request_id", router.RequestID(req)).Msg("Logged in")
+		http.Redirect(w, req, returnURL, http.StatusSeeOther)
+	})
+
+	// Logging out changes state, so it only takes a POST from this site, and other sites can't log users out
+	r.POST(strings.TrimSuffix(path, "/")+"/logout", l.BaseResource, func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		if !auth.SameOrigin(req) {
+			router.Error(w, req, http.StatusForbidden, "Cross-origin logout is not allowed")
+			return
+		}
+		if sessions := r.Sessions(); sessions != nil {
+			sessions.Clear(w)
+		}
+		http.Redirect(w, req, path, http.StatusSeeOther)
+	})
+
+	return nil
+}
+
+func (l *Login) render(w http.ResponseWriter, req *http.Request, status int, data loginPageData) {
+	data.Title = l.title
+	data.Action = req.URL.Path
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := loginPage.Execute(w, data); err != nil {
+		log.Error().Err(err).Msg("Error rendering login page")
+	}
+}
+
+// returnURL only allows paths on this site, so the login page can't redirect users elsewhere.
+func (l *Login) returnURL(target string) string {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") {
+		return l.defaultReturn
+	}
+	return target
+}
@@ -1,80 +1,434 @@
 package resources
 
 import (
+	"aspen/config"
+	"aspen/proxy"
 	"aspen/router"
+	"aspen/router/service"
 	"aspen/utils"
 	"fmt"
-	"io"
 	"net/http"
-	"time"
+	"net/url"
+	"sync"
 
 	"github.com/julienschmidt/httprouter"
 )
 
 type ProxyResource struct {
-	host    string
-	path    utils.Path
-	methods []string
+	upstreams      []ProxyUpstreamParams
+	services       []ProxyServiceParams
+	transport      string
+	tls            config.TLSConfig
+	h2c            bool // Only speak HTTP/2 to upstreams, for gRPC
+	balancer       proxy.BalancerOptions
+	trustedProxies []string
+	rewrite        ProxyRewriteParams
+	path           utils.Path
+	methods        []string
+	options        proxy.Options
+	cachedResource
 	router.BaseResource
+
+	// Set once handlers are added
+	forwarder *proxy.Proxy
 }
 
 type ProxyParams struct {
-	Host    string
+	// Host is shorthand for a single upstream. Use Upstreams to balance between several.
+	Host      string
+	Upstreams []ProxyUpstreamParams
+	Balancer  ProxyBalancerParams
+
+	// Service routes to a managed service by ID instead of a fixed host. It can be combined with other upstreams.
+	Service ProxyServiceParams
+
 	Path    string
 	Methods []string
+
+	// Optional settings for WebSocket and other Upgrade requests
+	Upgrade ProxyUpgradeParams
+
+	// Optional active and passive upstream health checks
+	HealthCheck ProxyHealthCheckParams
+
+	// Clients in these CIDR ranges are trusted to set forwarding headers like X-Forwarded-For
+	TrustedProxies []string
+
+	// Optional retry policy, and circuit breaker for each upstream
+	Retry          ProxyRetryParams
+	CircuitBreaker ProxyCircuitBreakerParams
+
+	// Optional header and body rewriting
+	Rewrite ProxyRewriteParams
+
+	// Name of a shared transport profile for upstream connections, from the top-level Transports
+	Transport string
+	// Optional TLS settings for HTTPS upstreams, replacing those of the transport profile
+	TLS config.TLSConfig
+
+	// Optional response caching
+	Cache CacheParams
+}
+
+type ProxyUpstreamParams struct {
+	Host   string
+	Weight int
+}
+
+type ProxyServiceParams struct {
+	Id string
+	// Selects the compose service and container port to route to, if the service publishes several
+	ComposeService string
+	Port           int
+	// Defaults to "http"
+	Scheme string
+	Weight int
+}
+
+type ProxyBalancerParams struct {
+	// One of "round_robin" (default), "weighted_random", "least_connections" or "consistent_hash"
+	Strategy string
+	// For consistent_hash: "ip" (default), "header:<name>" or "cookie:<name>"
+	HashOn string
+}
+
+type ProxyUpgradeParams struct {
+	Disabled         bool
+	IdleTimeout      utils.Duration
+	HandshakeTimeout utils.Duration
+}
+
+type ProxyHealthCheckParams struct {
+	// Active checks, enabled by setting Path
+	Path               string
+	Interval           utils.Duration
+	Timeout            utils.Duration
+	ExpectedStatus     []int
+	HealthyThreshold   int
+	UnhealthyThreshold int
+
+	// Passive checks, enabled by setting MaxFailures
+	MaxFailures  int
+	EjectionTime utils.Duration
+}
+
+type ProxyRetryParams struct {
+	MaxAttempts        int
+	RetryOn            []int
+	RetryErrors        []string
+	RetryNonIdempotent bool
+	PerTryTimeout      utils.Duration
+	Backoff            utils.Duration
+	MaxBackoff         utils.Duration
+	MaxBodyBytes       int64
+}
+
+type ProxyCircuitBreakerParams struct {
+	FailureThreshold int
+	OpenDuration     utils.Duration
+	HalfOpenRequests int
+	SuccessThreshold int
+}
+
+type ProxyRewriteParams struct {
+	Request  ProxyHeaderRulesParams
+	Response ProxyHeaderRulesParams
+
+	// Map Location headers and cookie paths from the upstream path onto the route path
+	Location     bool
+	CookiePath   bool
+	CookieDomain map[string]string
+
+	Body             []ProxyBodyRuleParams
+	BodyContentTypes []string
+	MaxBodyBytes     int64
+}
+
+type ProxyHeaderRulesParams struct {
+	Set    map[string]string
+	Add    map[string]string
+	Remove []string
+}
+
+type ProxyBodyRuleParams struct {
+	Pattern string
+	Replace string
 }
 
 func NewProxyResource(base router.BaseResource, params ProxyParams) router.Resource {
+	upstreams := params.Upstreams
+	if params.Host != "" {
+		upstreams = append([]ProxyUpstreamParams{{Host: params.Host, Weight: 1}}, upstreams...)
+	}
+
+	var services []ProxyServiceParams
+	if params.Service.Id != "" {
+		services = append(services, params.Service)
+	}
+
 	return &ProxyResource{
-		host:         params.Host,
-		path:         utils.ParsePath(params.Path),
-		methods:      params.Methods,
-		BaseResource: base,
+		upstreams: upstreams,
+		services:  services,
+		transport: params.Transport,
+		tls:       params.TLS,
+		balancer: proxy.BalancerOptions{
+			Strategy: params.Balancer.Strategy,
+			HashOn:   params.Balancer.HashOn,
+		},
+		trustedProxies: params.TrustedProxies,
+		rewrite:        params.Rewrite,
+		path:           utils.ParsePath(params.Path),
+		methods:        params.Methods,
+		options: proxy.Options{
+			Upgrade: proxy.UpgradeOptions{
+				Disabled:         params.Upgrade.Disabled,
+				IdleTimeout:      params.Upgrade.IdleTimeout.Std(),
+				HandshakeTimeout: params.Upgrade.HandshakeTimeout.Std(),
+			},
+			Health: proxy.HealthOptions{
+				Path:               params.HealthCheck.Path,
+				Interval:           params.HealthCheck.Interval.Std(),
+				Timeout:            params.HealthCheck.Timeout.Std(),
+				ExpectedStatus:     params.HealthCheck.ExpectedStatus,
+				HealthyThreshold:   params.HealthCheck.HealthyThreshold,
+				UnhealthyThreshold: params.HealthCheck.UnhealthyThreshold,
+				MaxFailures:        params.HealthCheck.MaxFailures,
+				EjectionTime:       params.HealthCheck.EjectionTime.Std(),
+			},
+			Retry: proxy.RetryOptions{
+				MaxAttempts:        params.Retry.MaxAttempts,
+				RetryOn:            params.Retry.RetryOn,
+				RetryErrors:        params.Retry.RetryErrors,
+				RetryNonIdempotent: params.Retry.RetryNonIdempotent,
+				PerTryTimeout:      params.Retry.PerTryTimeout.Std(),
+				Backoff:            params.Retry.Backoff.Std(),
+				MaxBackoff:         params.Retry.MaxBackoff.Std(),
+				MaxBodyBytes:       params.Retry.MaxBodyBytes,
+			},
+			Breaker: proxy.BreakerOptions{
+				FailureThreshold: params.CircuitBreaker.FailureThreshold,
+				OpenDuration:     params.CircuitBreaker.OpenDuration.Std(),
+				HalfOpenRequests: params.CircuitBreaker.HalfOpenRequests,
+				SuccessThreshold: params.CircuitBreaker.SuccessThreshold,
+			},
+			WriteError: router.Error,
+		},
+		cachedResource: cachedResource{cacheParams: params.Cache},
+		BaseResource:   base,
 	}
 }
 
 func (pr *ProxyResource) AddHandlers(path string, router *router.RouterInstance) error {
-	// Check that the proxy path and given path have matching variables
-	if !pr.path.IsProxyCompatible(utils.ParsePath(path)) {
-		return fmt.Errorf("proxy path '%s' is not compatible with redirect path '%s'", path, pr.path)
+	forwarder, err := pr.newForwarder(path, router)
+	if err != nil {
+		return err
 	}
 
-	// Every proxy request uses the same client (safe for concurrent use)
-	proxyClient := &http.Client{
-		Timeout: time.Second * 10,
-	}
+	pr.initCache(router)
 
 	// Register the proxy handler for the specified methods
 	for _, method := range pr.methods {
 		router.Handle(method, path, pr.BaseResource, func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
-			constructedPath := pr.host + pr.path.ConstructPath(ps)
+			pr.serveCached(w, req, func(w http.ResponseWriter, req *http.Request) {
+				forwarder.Forward(w, req, pr.path.ConstructPath(ps))
+			})
+		})
+	}
 
-			// Create a new request to the destination host and path
-			proxyReq, err := http.NewRequest(method, constructedPath, req.Body)
-			if err != nil {
-				http.Error(w, fmt.Sprintf("Error creating proxy request: %v", err), http.StatusInternalServerError)
-				return
-			}
-			proxyReq.Header = req.Header
+	return nil
+}
+
+// newForwarder creates the proxy for requests to the given route, which is started and stopped with the router.
+// Every request for this resource goes through the same proxy (safe for concurrent use).
+func (pr *ProxyResource) newForwarder(path string, router *router.RouterInstance) (*proxy.Proxy, error) {
+	// Check that the proxy path and given path have matching variables
+	if !pr.path.IsProxyCompatible(utils.ParsePath(path)) {
+		return nil, fmt.Errorf("proxy path '%s' is not compatible with redirect path '%s'", path, pr.path)
+	}
 
-			// Forward the request to the destination host
-			resp, err := proxyClient.Do(proxyReq)
+	upstreams := make([]*proxy.Upstream, len(pr.upstreams))
+	for i, params := range pr.upstreams {
+		upstream, err := proxy.NewUpstream(params.Host, params.Weight)
+		if err != nil {
+			return nil, err
+		}
+		upstreams[i] = upstream
+	}
+
+	for _, params := range pr.services {
+		svc := router.GetService(params.Id)
+		if svc == nil {
+			return nil, fmt.Errorf("proxy references unknown service '%s'", params.Id)
+		}
+		resolver := &serviceResolver{service: svc, params: params}
+		upstreams = append(upstreams, proxy.NewResolvedUpstream("service:"+params.Id, resolver, params.Weight))
+	}
+
+	balancer, err := proxy.NewBalancer(upstreams, pr.balancer)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create load balancer: %w", err)
+	}
+
+	trustedProxies, err := proxy.ParseTrustedProxies(pr.trustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	rewrite, err := pr.rewriteOptions(utils.ParsePath(path))
+	if err != nil {
+		return nil, err
+	}
+
+	transport, err := pr.newTransport(router)
+	if err != nil {
+		return nil, err
+	}
+
+	options := pr.options
+	options.Forwarded.TrustedProxies = trustedProxies
+	options.Rewrite = rewrite
+	options.Transport = transport
+
+	forwarder := proxy.New(balancer, options)
+	pr.forwarder = forwarder
+	router.OnStart(forwarder.Start)
+	router.OnStop(forwarder.Stop)
+
+	return forwarder, nil
+}
+
+// newTransport returns the transport for upstream connections: the named profile, or the shared default.
+// Routes with their own TLS settings, or that need HTTP/2, get a private copy of that transport.
+func (pr *ProxyResource) newTransport(router *router.RouterInstance) (*http.Transport, error) {
+	var profile *http.Transport
+	if pr.transport != "" {
+		profile = router.GetTransport(pr.transport)
+		if profile == nil {
+			return nil, fmt.Errorf("proxy references unknown transport '%s'", pr.transport)
+		}
+	}
+
+	if !pr.tls.IsSet() && !pr.h2c {
+		return profile, nil
+	}
+
+	tlsOptions, err := pr.tls.Parse()
+	if err != nil {
+		return nil, err
+	}
+
+	var transport *http.Transport
+	if profile != nil {
+		transport = profile.Clone()
+		if pr.tls.IsSet() {
+			tlsConfig, err := tlsOptions.Config()
 			if err != nil {
-				http.Error(w, fmt.Sprintf("Error forwarding request: %v", err), http.StatusInternalServerError)
-				return
+				return nil, err
 			}
-			defer resp.Body.Close()
+			transport.TLSClientConfig = tlsConfig
+		}
+		if pr.h2c {
+			proxy.EnableH2C(transport)
+		}
+	} else {
+		transport, err = proxy.NewTransport(proxy.TransportOptions{H2C: pr.h2c, TLS: tlsOptions})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	router.OnStop(transport.CloseIdleConnections)
+	return transport, nil
+}
+
+// rewriteOptions builds the proxy rewrite options, mapping upstream paths onto the given route.
+func (pr *ProxyResource) rewriteOptions(route utils.Path) (proxy.RewriteOptions, error) {
+	options := proxy.RewriteOptions{
+		Request:          proxy.HeaderRules(pr.rewrite.Request),
+		Response:         proxy.HeaderRules(pr.rewrite.Response),
+		Location:         pr.rewrite.Location,
+		CookiePath:       pr.rewrite.CookiePath,
+		CookieDomain:     pr.rewrite.CookieDomain,
+		BodyContentTypes: pr.rewrite.BodyContentTypes,
+		MaxBodyBytes:     pr.rewrite.MaxBodyBytes,
 
-			// Relay response back to the original client
-			for key, values := range resp.Header {
-				for _, value := range values {
-					w.Header().Add(key, value)
-				}
+		// An upstream path is public if it matches the proxy path, and then lives under the same variables on the route
+		MapPath: func(upstreamPath string) (string, bool) {
+			variables, ok := pr.path.Match(upstreamPath)
+			if !ok {
+				return "", false
 			}
-			w.WriteHeader(resp.StatusCode)
-			io.Copy(w, resp.Body)
-		})
+			return route.ConstructPath(variables), true
+		},
 	}
 
-	return nil
+	for _, params := range pr.rewrite.Body {
+		rule, err := proxy.CompileBodyRule(params.Pattern, params.Replace)
+		if err != nil {
+			return proxy.RewriteOptions{}, err
+		}
+		options.Body = append(options.Body, rule)
+	}
+
+	return options, nil
+}
+
+// UpstreamStatus returns the state of each upstream this resource forwards to.
+func (pr *ProxyResource) UpstreamStatus() []proxy.UpstreamStatus {
+	if pr.forwarder == nil {
+		return nil
+	}
+
+	var statuses []proxy.UpstreamStatus
+	for _, upstream := range pr.forwarder.Balancer().Upstreams() {
+		statuses = append(statuses, upstream.Status())
+	}
+	return statuses
+}
+
+// serviceResolver resolves the address of a managed service. The address is cached while the service
+// is running, and looked up again once it restarts or refuses a connection.
+type serviceResolver struct {
+	service *service.Service
+	params  ProxyServiceParams
+
+	lock   sync.Mutex
+	target *url.URL
+}
+
+func (sr *serviceResolver) Ready() bool {
+	if sr.service.GetStatus() != service.Started {
+		sr.Invalidate()
+		return false
+	}
+	return true
+}
+
+func (sr *serviceResolver) Resolve() (*url.URL, error) {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+
+	if status := sr.service.GetStatus(); status != service.Started {
+		return nil, fmt.Errorf("service %s is %s: %w", sr.service.GetID(), status, proxy.ErrNoUpstream)
+	}
+	if sr.target != nil {
+		return sr.target, nil
+	}
+
+	address, err := sr.service.Address(sr.params.ComposeService, sr.params.Port)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", proxy.ErrNoUpstream, err)
+	}
+
+	scheme := sr.params.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	sr.target = &url.URL{Scheme: scheme, Host: address}
+	return sr.target, nil
+}
+
+func (sr *serviceResolver) Invalidate() {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+	sr.target = nil
 }
@@ -10,4 +10,7 @@ func RegisterResources() {
 	config.RegisterResourceConstructor[RouterAPIParams]("api", NewRouterAPIResource)
 	config.RegisterResourceConstructor[RedirectParams]("redirect", NewRedirectResource)
 	config.RegisterResourceConstructor[ProxyParams]("proxy", NewProxyResource)
+	config.RegisterResourceConstructor[SplitParams]("split", NewSplitResource)
+	config.RegisterResourceConstructor[GRPCProxyParams]("grpc_proxy", NewGRPCProxyResource)
+	config.RegisterResourceConstructor[LoginParams]("login", NewLogin)
 }
@@ -0,0 +1,242 @@
+package resources
+
+import (
+	"aspen/proxy"
+	"aspen/router"
+	"aspen/utils"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// SplitResource splits traffic for a route between several proxy targets, e.g. for canary releases.
+// Requests matching a rule go to its target, and the rest are divided by weight.
+type SplitResource struct {
+	targets []*splitTarget
+	rules   []SplitRuleParams
+	methods []string
+	router.BaseResource
+
+	// Optional shadow target, whose responses are discarded
+	mirror        *ProxyResource
+	mirrorOptions proxy.MirrorOptions
+}
+
+type splitTarget struct {
+	name   string
+	weight int
+	*ProxyResource
+}
+
+type SplitParams struct {
+	Path    string
+	Methods []string
+
+	Targets []SplitTargetParams
+	Rules   []SplitRuleParams
+
+	// Optional shadow target that receives a copy of requests
+	Mirror SplitMirrorParams
+}
+
+// SplitTargetParams takes the same parameters as a proxy resource. Its Path defaults to that of the split.
+type SplitTargetParams struct {
+	Name string
+	// Share of the traffic that doesn't match any rule. Targets with weight 0 only receive matched traffic.
+	Weight int
+	ProxyParams
+}
+
+// SplitRuleParams sends requests with a matching header or cookie to a target.
+// If Value is empty, the header or cookie only needs to be present.
+type SplitRuleParams struct {
+	Header string
+	Cookie string
+	Value  string
+	Target string
+}
+
+type SplitMirrorParams struct {
+	// Percentage of requests to mirror (default 100)
+	Percent      float64
+	QueueSize    int
+	Workers      int
+	Timeout      utils.Duration
+	MaxBodyBytes int64
+	ProxyParams
+}
+
+func NewSplitResource(base router.BaseResource, params SplitParams) router.Resource {
+	targets := make([]*splitTarget, len(params.Targets))
+	for i, target := range params.Targets {
+		if target.Path == "" {
+			target.Path = params.Path
+		}
+		targets[i] = &splitTarget{
+			name:          target.Name,
+			weight:        target.Weight,
+			ProxyResource: NewProxyResource(base, target.ProxyParams).(*ProxyResource),
+		}
+	}
+
+	var mirror *ProxyResource
+	mirrorParams := params.Mirror.ProxyParams
+	if mirrorParams.Host != "" || len(mirrorParams.Upstreams) > 0 || mirrorParams.Service.Id != "" {
+		if mirrorParams.Path == "" {
+			mirrorParams.Path = params.Path
+		}
+		mirror = NewProxyResource(base, mirrorParams).(*ProxyResource)
+	}
+
+	return &SplitResource{
+		targets: targets,
+		rules:   params.Rules,
+		methods: params.Methods,
+		mirror:  mirror,
+		mirrorOptions: proxy.MirrorOptions{
+			Percent:      params.Mirror.Percent,
+			QueueSize:    params.Mirror.QueueSize,
+			Workers:      params.Mirror.Workers,
+			Timeout:      params.Mirror.Timeout.Std(),
+			MaxBodyBytes: params.Mirror.MaxBodyBytes,
+		},
+		BaseResource: base,
+	}
+}
+
+func (sr *SplitResource) AddHandlers(path string, router *router.RouterInstance) error {
+	if err := sr.validate(); err != nil {
+		return err
+	}
+
+	forwarders := make([]*proxy.Proxy, len(sr.targets))
+	for i, target := range sr.targets {
+		forwarder, err := target.newForwarder(path, router)
+		if err != nil {
+			return fmt.Errorf("error creating split target '%s': %w", target.name, err)
+		}
+		forwarders[i] = forwarder
+	}
+
+	var mirror *proxy.Mirror
+	if sr.mirror != nil {
+		forwarder, err := sr.mirror.newForwarder(path, router)
+		if err != nil {
+			return fmt.Errorf("error creating split mirror: %w", err)
+		}
+		mirror = proxy.NewMirror(forwarder, sr.mirrorOptions)
+		router.OnStart(mirror.Start)
+		router.OnStop(mirror.Stop)
+	}
+
+	for _, method := range sr.methods {
+		router.Handle(method, path, sr.BaseResource, func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+			// Copy the request before the target reads its body
+			if mirror != nil {
+				mirror.Send(req, sr.mirror.path.ConstructPath(ps))
+			}
+
+			i := sr.choose(req)
+			forwarders[i].Forward(w, req, sr.targets[i].path.ConstructPath(ps))
+		})
+	}
+
+	return nil
+}
+
+// validate checks that every target has a name, and that rules refer to existing targets.
+func (sr *SplitResource) validate() error {
+	if len(sr.targets) == 0 {
+		return fmt.Errorf("split needs at least one target")
+	}
+
+	names := make(map[string]bool)
+	total := 0
+	for _, target := range sr.targets {
+		if target.name == "" {
+			return fmt.Errorf("split targets must have a name")
+		}
+		if names[target.name] {
+			return fmt.Errorf("duplicate split target '%s'", target.name)
+		}
+		if target.weight < 0 {
+			return fmt.Errorf("split target '%s' has negative weight", target.name)
+		}
+		names[target.name] = true
+		total += target.weight
+	}
+	if total == 0 {
+		return fmt.Errorf("split needs at least one target with a weight")
+	}
+
+	for _, rule := range sr.rules {
+		if !names[rule.Target] {
+			return fmt.Errorf("split rule refers to unknown target '%s'", rule.Target)
+		}
+		if (rule.Header == "") == (rule.Cookie == "") {
+			return fmt.Errorf("split rule for target '%s' must match either a header or a cookie", rule.Target)
+		}
+	}
+
+	return nil
+}
+
+// choose returns the index of the target for a request: the first matching rule, or else a weighted random pick.
+func (sr *SplitResource) choose(req *http.Request) int {
+	for _, rule := range sr.rules {
+		if rule.matches(req) {
+			for i, target := range sr.targets {
+				if target.name == rule.Target {
+					return i
+				}
+			}
+		}
+	}
+
+	total := 0
+	for _, target := range sr.targets {
+		total += target.weight
+	}
+
+	n := rand.IntN(total)
+	for i, target := range sr.targets {
+		if n < target.weight {
+			return i
+		}
+		n -= target.weight
+	}
+	return len(sr.targets) - 1
+}
+
+func (rule SplitRuleParams) matches(req *http.Request) bool {
+	var value string
+	if rule.Header != "" {
+		values, ok := req.Header[http.CanonicalHeaderKey(rule.Header)]
+		if !ok {
+			return false
+		}
+		value = values[0]
+	} else {
+		cookie, err := req.Cookie(rule.Cookie)
+		if err != nil {
+			return false
+		}
+		value = cookie.Value
+	}
+
+	return rule.Value == "" || value == rule.Value
+}
+
+// UpstreamStatus returns the state of the upstreams of every target, and of the mirror.
+func (sr *SplitResource) UpstreamStatus() []proxy.UpstreamStatus {
+	var statuses []proxy.UpstreamStatus
+	for _, target := range sr.targets {
+		statuses = append(statuses, target.UpstreamStatus()...)
+	}
+	if sr.mirror != nil {
+		statuses = append(statuses, sr.mirror.UpstreamStatus()...)
+	}
+	return statuses
+}
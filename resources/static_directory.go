@@ -16,6 +16,7 @@ type StaticDirectory struct {
 	// Paths are relative to the base path, and '*' can be used to serve all files within a directory.
 	whitelist                []string
 	allow_directory_browsing bool
+	cachedResource
 	router.BaseResource
 }
 
@@ -23,6 +24,7 @@ type StaticDirectoryParams struct {
 	Path                   string
 	Whitelist              []string
 	AllowDirectoryBrowsing bool
+	Cache                  CacheParams
 }
 
 func NewStaticDirectory(base router.BaseResource, params StaticDirectoryParams) router.Resource {
@@ -35,6 +37,7 @@ func NewStaticDirectory(base router.BaseResource, params StaticDirectoryParams)
 		path:                     params.Path,
 		whitelist:                params.Whitelist,
 		allow_directory_browsing: params.AllowDirectoryBrowsing,
+		cachedResource:           cachedResource{cacheParams: params.Cache},
 		BaseResource:             base,
 	}
 }
@@ -42,7 +45,9 @@ func NewStaticDirectory(base router.BaseResource, params StaticDirectoryParams)
 /*
 Adds handlers serving each of the static files in the whitelist under this directory. Uses the path as the base path.
 */
-func (sd *StaticDirectory) AddHandlers(path string, router *router.RouterInstance) error {
+func (sd *StaticDirectory) AddHandlers(path string, r *router.RouterInstance) error {
+	sd.initCache(r)
+
 	for _, file := range sd.whitelist {
 		var reqpath string
 		if strings.HasSuffix(file, "*") {
@@ -52,17 +57,19 @@ func (sd *StaticDirectory) AddHandlers(path string, router *router.RouterInstanc
 			reqpath = path + "/" + file
 		}
 
-		router.GET(reqpath, sd.BaseResource, func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		r.GET(reqpath, sd.BaseResource, func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 			filepath := sd.path + "/" + req.URL.Path[len(path)+1:]
 
 			// Check if the file exists and we're allowed to serve it
 			info, err := os.Stat(filepath)
 			if err != nil || (!sd.allow_directory_browsing && info.IsDir()) {
-				http.NotFound(w, req)
+				router.Error(w, req, http.StatusNotFound, "404 page not found")
 				return
 			}
 
-			http.ServeFile(w, req, filepath)
+			sd.serveCached(w, req, func(w http.ResponseWriter, req *http.Request) {
+				http.ServeFile(w, req, filepath)
+			})
 		})
 	}
 	return nil
@@ -9,17 +9,20 @@ import (
 
 type StaticFile struct {
 	filepath string
+	cachedResource
 	router.BaseResource
 }
 
 type StaticFileParams struct {
 	Filepath string
+	Cache    CacheParams
 }
 
 func NewStaticFile(base router.BaseResource, params StaticFileParams) router.Resource {
 	return &StaticFile{
-		filepath:     params.Filepath,
-		BaseResource: base,
+		filepath:       params.Filepath,
+		cachedResource: cachedResource{cacheParams: params.Cache},
+		BaseResource:   base,
 	}
 }
 
@@ -27,8 +30,12 @@ func NewStaticFile(base router.BaseResource, params StaticFileParams) router.Res
 Adds a single GET handler returning the static file under the given path.
 */
 func (sr *StaticFile) AddHandlers(path string, router *router.RouterInstance) error {
+	sr.initCache(router)
+
 	router.GET(path, sr.BaseResource, func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
-		http.ServeFile(w, req, sr.filepath)
+		sr.serveCached(w, req, func(w http.ResponseWriter, req *http.Request) {
+			http.ServeFile(w, req, sr.filepath)
+		})
 	})
 	return nil
 }
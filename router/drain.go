@@ -0,0 +1,149 @@
+package router
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// How often a draining instance checks for its last requests, and logs its progress
+const (
+	drainPollInterval = 100 * time.Millisecond
+	drainLogInterval  = 5 * time.Second
+)
+
+// InstanceStatus describes a router instance that is serving or draining requests.
+type InstanceStatus struct {
+	// Counts the instances made active, starting at 1
+	Generation uint64    `json:"generation"`
+	InFlight   int64     `json:"in_flight"`
+	Started    time.Time `json:"started"`
+	// Set for draining instances, which are stopped at the deadline even if requests are left
+	DrainDeadline *time.Time `json:"drain_deadline,omitempty"`
+}
+
+// RouterStatus describes the active router instance, and the replaced instances still draining.
+type RouterStatus struct {
+	Active   *InstanceStatus  `json:"active"`
+	Draining []InstanceStatus `json:"draining"`
+}
+
+// drain is a replaced instance finishing its requests before it is stopped.
+type drain struct {
+	instance *RouterInstance
+	deadline time.Time
+	// Closed to stop waiting for requests, e.g. on shutdown
+	cancel chan struct{}
+}
+
+// drains tracks the instances that are draining.
+type drains struct {
+	lock   sync.Mutex
+	active map[*RouterInstance]*drain
+	wg     sync.WaitGroup
+}
+
+// start drains an instance in the background, then stops it.
+func (d *drains) start(instance *RouterInstance) {
+	// Requests that see this flag go to the new instance instead
+	instance.draining.Store(true)
+
+	dr := &drain{
+		instance: instance,
+		deadline: time.Now().Add(instance.options.DrainTimeout),
+		cancel:   make(chan struct{}),
+	}
+	d.lock.Lock()
+	if d.active == nil {
+		d.active = make(map[*RouterInstance]*drain)
+	}
+	d.active[instance] = dr
+	d.lock.Unlock()
+
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		dr.wait()
+
+		log.Info().Uint64("generation", instance.generation).Msg("Stopping old router instance services")
+		if err := instance.Stop(); err != nil {
+			log.Error().Err(err).Uint64("generation", instance.generation).Msg("Error stopping old router instance services")
+		}
+
+		d.lock.Lock()
+		delete(d.active, instance)
+		d.lock.Unlock()
+	}()
+}
+
+// wait returns once the instance has no requests in flight, or the drain deadline passes.
+func (dr *drain) wait() {
+	logger := log.With().Uint64("generation", dr.instance.generation).Logger()
+	logger.Info().Int64("in_flight", dr.instance.inFlight.Load()).Time("deadline", dr.deadline).Msg("Draining old router instance")
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	lastLog := time.Now()
+	for {
+		inFlight := dr.instance.inFlight.Load()
+		if inFlight == 0 {
+			logger.Info().Msg("Old router instance drained")
+			return
+		}
+		if time.Now().After(dr.deadline) {
+			logger.Warn().Int64("in_flight", inFlight).Msg("Drain timed out, stopping old router instance with requests in flight")
+			return
+		}
+		if time.Since(lastLog) >= drainLogInterval {
+			logger.Info().Int64("in_flight", inFlight).Msg("Waiting for requests on old router instance")
+			lastLog = time.Now()
+		}
+
+		select {
+		case <-ticker.C:
+		case <-dr.cancel:
+			logger.Warn().Int64("in_flight", dr.instance.inFlight.Load()).Msg("Drain cancelled, stopping old router instance")
+			return
+		}
+	}
+}
+
+// stopAll cuts every drain short, and waits for the instances to stop.
+func (d *drains) stopAll() {
+	d.lock.Lock()
+	for _, dr := range d.active {
+		close(dr.cancel)
+	}
+	d.active = nil
+	d.lock.Unlock()
+
+	d.wg.Wait()
+}
+
+// statuses returns the status of each draining instance, oldest first.
+func (d *drains) statuses() []InstanceStatus {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	statuses := make([]InstanceStatus, 0, len(d.active))
+	for _, dr := range d.active {
+		status := dr.instance.status()
+		status.DrainDeadline = &dr.deadline
+		statuses = append(statuses, status)
+	}
+	slices.SortFunc(statuses, func(a, b InstanceStatus) int {
+		return cmp.Compare(a.Generation, b.Generation)
+	})
+	return statuses
+}
+
+func (r *RouterInstance) status() InstanceStatus {
+	return InstanceStatus{
+		Generation: r.generation,
+		InFlight:   r.inFlight.Load(),
+		Started:    r.started,
+	}
+}
@@ -0,0 +1,195 @@
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	htmltemplate "html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ErrorData is passed to error page templates.
+type ErrorData struct {
+	Status     int
+	StatusText string
+	Message    string
+	RequestID  string
+	Method     string
+	Path       string
+}
+
+// ErrorTemplates renders an error as HTML or JSON. Either template may be nil.
+type ErrorTemplates struct {
+	HTML *htmltemplate.Template
+	// Rendered with text/template, which has a "json" function to encode values
+	JSON *template.Template
+}
+
+// ErrorPages holds the templates used to render errors. Templates for a status code ("404")
+// win over ones for its class ("4xx"), which win over the default templates.
+type ErrorPages struct {
+	Default  ErrorTemplates
+	Statuses map[string]ErrorTemplates
+}
+
+// ErrorTemplateFuncs are available to JSON error templates.
+var ErrorTemplateFuncs = template.FuncMap{
+	"json": func(value any) (string, error) {
+		data, err := json.Marshal(value)
+		return string(data), err
+	},
+}
+
+// templates returns the HTML and JSON templates for a status, either of which may be nil.
+func (ep *ErrorPages) templates(status int) (htmlTemplate *htmltemplate.Template, jsonTemplate *template.Template) {
+	if ep == nil {
+		return nil, nil
+	}
+
+	code := strconv.Itoa(status)
+	for _, key := range []string{code, code[:1] + "xx"} {
+		templates := ep.Statuses[key]
+		if htmlTemplate == nil {
+			htmlTemplate = templates.HTML
+		}
+		if jsonTemplate == nil {
+			jsonTemplate = templates.JSON
+		}
+	}
+	if htmlTemplate == nil {
+		htmlTemplate = ep.Default.HTML
+	}
+	if jsonTemplate == nil {
+		jsonTemplate = ep.Default.JSON
+	}
+	return htmlTemplate, jsonTemplate
+}
+
+// Error responds with an error page for the status. The format is negotiated from the Accept header:
+// the route's templates are preferred, then the instance's, then a built-in JSON body or plain text.
+func Error(w http.ResponseWriter, req *http.Request, status int, message string) {
+	state := requestStateOf(req)
+	if state == nil {
+		http.Error(w, message, status)
+		return
+	}
+
+	data := ErrorData{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Message:    message,
+		RequestID:  state.id,
+		Method:     req.Method,
+		Path:       req.URL.Path,
+	}
+
+	htmlTemplate, jsonTemplate := state.routePages.templates(status)
+	instanceHTML, instanceJSON := state.instance.options.ErrorPages.templates(status)
+	if htmlTemplate == nil {
+		htmlTemplate = instanceHTML
+	}
+	if jsonTemplate == nil {
+		jsonTemplate = instanceJSON
+	}
+
+	var body bytes.Buffer
+	var err error
+	contentType := negotiate(req.Header.Get("Accept"), htmlTemplate != nil)
+	switch {
+	case contentType == "text/html":
+		err = htmlTemplate.Execute(&body, data)
+	case contentType == "application/json" && jsonTemplate != nil:
+		err = jsonTemplate.Execute(&body, data)
+	case contentType == "application/json":
+		err = defaultJSONError(&body, data)
+	default:
+		contentType = "text/plain"
+		body.WriteString(message + "\n")
+	}
+
+	if err != nil {
+		log.Error().Err(err).Str("request_id", state.id).Int("status", status).Msg("Error rendering error page")
+		http.Error(w, message, status)
+		return
+	}
+
+	// Drop headers meant for the response that failed, like http.Error does
+	header := w.Header()
+	header.Del("Content-Length")
+	header.Del("Content-Encoding")
+	header.Set("Content-Type", contentType+"; charset=utf-8")
+	header.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(body.Bytes())
+}
+
+func defaultJSONError(body *bytes.Buffer, data ErrorData) error {
+	return json.NewEncoder(body).Encode(struct {
+		Status    int    `json:"status"`
+		Error     string `json:"error"`
+		RequestID string `json:"request_id"`
+	}{data.Status, data.Message, data.RequestID})
+}
+
+// negotiate picks the error page format the client prefers: "text/html", "application/json" or "text/plain".
+// HTML is only offered if there is an HTML template. For "*/*" the first offer wins: HTML if there is
+// a template, and otherwise plain text, so JSON has to be asked for.
+func negotiate(accept string, hasHTML bool) string {
+	offers := []string{"text/plain", "application/json"}
+	if hasHTML {
+		offers = []string{"text/html", "application/json", "text/plain"}
+	}
+	if accept == "" {
+		return "text/plain"
+	}
+
+	best, bestQuality, bestSpecificity := "text/plain", 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+
+		quality := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if value, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if q, err := strconv.ParseFloat(value, 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		if quality <= 0 {
+			continue
+		}
+
+		for _, offer := range offers {
+			specificity := matchMediaType(mediaType, offer)
+			if specificity < 0 {
+				continue
+			}
+			// Prefer higher quality, then a more specific match, then the earlier offer
+			if quality > bestQuality || (quality == bestQuality && specificity > bestSpecificity) {
+				best, bestQuality, bestSpecificity = offer, quality, specificity
+			}
+			break
+		}
+	}
+	return best
+}
+
+// matchMediaType returns how specifically a media range from an Accept header matches a media type,
+// or -1 if it doesn't match.
+func matchMediaType(mediaRange, mediaType string) int {
+	switch {
+	case mediaRange == mediaType:
+		return 2
+	case strings.HasSuffix(mediaRange, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(mediaRange, "*")):
+		return 1
+	case mediaRange == "*/*":
+		return 0
+	default:
+		return -1
+	}
+}
@@ -0,0 +1,117 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Route assigns a resource to a path, optionally only for requests to a given host.
+type Route struct {
+	// Exact host like "example.com", or "*.example.com" for any subdomain. Empty for the default host.
+	Host     string
+	Path     string
+	Resource Resource
+
+	// Middleware run after the instance's middleware, or instead of it if OverrideMiddleware is set.
+	Middleware         []MiddlewareFunc
+	OverrideMiddleware bool
+
+	// Error pages for this route, falling back to the instance's error pages. Nil to only use the instance's.
+	ErrorPages *ErrorPages
+}
+
+// ValidateHost checks that a host pattern is an exact host, or a wildcard subdomain like "*.example.com".
+func ValidateHost(host string) error {
+	if host == "" {
+		return nil
+	}
+
+	name := strings.TrimPrefix(host, "*.")
+	if strings.ContainsAny(name, "*/:") || strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".") || name == "" {
+		return fmt.Errorf("invalid host '%s', expected a host like 'example.com' or '*.example.com'", host)
+	}
+	return nil
+}
+
+// hostRouters dispatches requests to the router of their host. Exact hosts are matched first,
+// then the wildcard with the longest suffix, and the default router handles any other host.
+type hostRouters struct {
+	fallback *httprouter.Router
+	// Creates the router for a host
+	create    func() *httprouter.Router
+	exact     map[string]*httprouter.Router
+	wildcards []wildcardRouter
+}
+
+type wildcardRouter struct {
+	// Suffix including the leading dot, e.g. ".example.com"
+	suffix string
+	router *httprouter.Router
+}
+
+func newHostRouters(fallback *httprouter.Router, create func() *httprouter.Router) *hostRouters {
+	return &hostRouters{
+		fallback: fallback,
+		create:   create,
+		exact:    make(map[string]*httprouter.Router),
+	}
+}
+
+// get returns the router for a host pattern, creating it if needed.
+// Paths without a route on a host fall back to the default router.
+func (hr *hostRouters) get(host string) *httprouter.Router {
+	host = strings.ToLower(host)
+	if host == "" {
+		return hr.fallback
+	}
+
+	if suffix, ok := strings.CutPrefix(host, "*"); ok {
+		for _, wildcard := range hr.wildcards {
+			if wildcard.suffix == suffix {
+				return wildcard.router
+			}
+		}
+		router := hr.newRouter()
+		hr.wildcards = append(hr.wildcards, wildcardRouter{suffix: suffix, router: router})
+		sort.SliceStable(hr.wildcards, func(i, j int) bool {
+			return len(hr.wildcards[i].suffix) > len(hr.wildcards[j].suffix)
+		})
+		return router
+	}
+
+	if router, ok := hr.exact[host]; ok {
+		return router
+	}
+	router := hr.newRouter()
+	hr.exact[host] = router
+	return router
+}
+
+func (hr *hostRouters) newRouter() *httprouter.Router {
+	router := hr.create()
+	router.NotFound = hr.fallback
+	return router
+}
+
+// match returns the router for the Host of a request.
+func (hr *hostRouters) match(requestHost string) *httprouter.Router {
+	host := requestHost
+	if hostname, _, err := net.SplitHostPort(requestHost); err == nil {
+		host = hostname
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	if router, ok := hr.exact[host]; ok {
+		return router
+	}
+	for _, wildcard := range hr.wildcards {
+		if strings.HasSuffix(host, wildcard.suffix) && len(host) > len(wildcard.suffix) {
+			return wildcard.router
+		}
+	}
+	return hr.fallback
+}
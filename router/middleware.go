@@ -1,12 +1,69 @@
 package router
 
 import (
+	"context"
 	"net/http"
 
 	"github.com/julienschmidt/httprouter"
 )
 
+// Middleware runs before a resource handler, and can only reject the request.
+// New middleware should be a MiddlewareFunc, which can also act on the response.
 type Middleware interface {
 	// Handle processes the request. If an error occurs, it should return an error and the corresponding error code.
 	Handle(res BaseResource, w http.ResponseWriter, req *http.Request, ps httprouter.Params) (error, int)
 }
+
+// MiddlewareFunc wraps the next handler in the chain. It can act before and after calling next, wrap the
+// ResponseWriter (see WrapResponseWriter) or not call next at all. The resource and route params of the
+// request are available through RequestResource and RequestParams.
+type MiddlewareFunc func(next http.Handler) http.Handler
+
+// AdaptMiddleware turns a Middleware into a MiddlewareFunc, which responds with the middleware's error
+// instead of calling the next handler.
+func AdaptMiddleware(middleware Middleware) MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if err, err_code := middleware.Handle(RequestResource(req), w, req, RequestParams(req)); err != nil {
+				Error(w, req, err_code, err.Error())
+				return
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// resourceKey is used to pass the resource handling a request through its context.
+type resourceKey struct{}
+
+// RequestResource returns the resource handling a request.
+func RequestResource(req *http.Request) BaseResource {
+	resource, _ := req.Context().Value(resourceKey{}).(BaseResource)
+	return resource
+}
+
+// RequestParams returns the route params of a request.
+func RequestParams(req *http.Request) httprouter.Params {
+	return httprouter.ParamsFromContext(req.Context())
+}
+
+// chain wraps a resource handler in middleware, so the first middleware runs first.
+// Errors of the handler and its middleware are rendered with the given error pages, if any.
+func chain(middleware []MiddlewareFunc, pages *ErrorPages, resource BaseResource, handle httprouter.Handle) httprouter.Handle {
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		handle(w, req, RequestParams(req))
+	})
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+
+	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		if state := requestStateOf(req); state != nil {
+			state.routePages = pages
+		}
+
+		ctx := context.WithValue(req.Context(), resourceKey{}, resource)
+		ctx = context.WithValue(ctx, httprouter.ParamsKey, ps)
+		handler.ServeHTTP(w, req.WithContext(ctx))
+	}
+}
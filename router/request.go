@@ -0,0 +1,114 @@
+package router
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/rs/zerolog/log"
+)
+
+// RequestIDHeader carries the ID of a request. An ID sent by the client is kept, so requests can be
+// traced through several proxies, and the ID is forwarded to upstreams and returned to the client.
+const RequestIDHeader = "X-Request-Id"
+
+// requestState is kept in the context of every request the router handles.
+// Handlers fill in the route specific parts once a route matches.
+type requestState struct {
+	id       string
+	instance *RouterInstance
+	// Error pages of the matched route, nil until a route matches
+	routePages *ErrorPages
+}
+
+// requestStateKey is used to pass the requestState through the request context.
+type requestStateKey struct{}
+
+func requestStateOf(req *http.Request) *requestState {
+	state, _ := req.Context().Value(requestStateKey{}).(*requestState)
+	return state
+}
+
+// RequestID returns the ID of a request, or an empty string outside the router.
+func RequestID(req *http.Request) string {
+	if state := requestStateOf(req); state != nil {
+		return state.id
+	}
+	return ""
+}
+
+// RequestInstance returns the router instance handling a request, or nil outside the router.
+func RequestInstance(req *http.Request) *RouterInstance {
+	if state := requestStateOf(req); state != nil {
+		return state.instance
+	}
+	return nil
+}
+
+// newRequestID returns the client's request ID if it looks sane, or a new random ID.
+func newRequestID(req *http.Request) string {
+	id := req.Header.Get(RequestIDHeader)
+	if validRequestID(id) {
+		return id
+	}
+
+	var random [16]byte
+	rand.Read(random[:])
+	return hex.EncodeToString(random[:])
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		isAlnum := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+		if !isAlnum && c != '-' && c != '_' && c != '.' && c != ':' {
+			return false
+		}
+	}
+	return true
+}
+
+// serve handles a request with the router of its host. Panics are logged with their stack trace,
+// and answered with an error page if nothing has been sent yet.
+func (r *RouterInstance) serve(w http.ResponseWriter, req *http.Request) {
+	state := &requestState{
+		id:       newRequestID(req),
+		instance: r,
+	}
+	req.Header.Set(RequestIDHeader, state.id)
+	w.Header().Set(RequestIDHeader, state.id)
+	req = req.WithContext(context.WithValue(req.Context(), requestStateKey{}, state))
+
+	rw := WrapResponseWriter(w)
+	defer func() {
+		recovered := recover()
+		if recovered == nil {
+			return
+		}
+		// Handlers abort responses with this on purpose, and net/http doesn't log it
+		if recovered == http.ErrAbortHandler {
+			panic(recovered)
+		}
+
+		log.Error().
+			Str("request_id", state.id).
+			Str("method", req.Method).
+			Str("path", req.URL.Path).
+			Str("panic", fmt.Sprint(recovered)).
+			Str("stack", string(debug.Stack())).
+			Msg("Panic while handling request")
+
+		// Once the response has started, the client can only be told by breaking the connection
+		if rw.Status() != 0 {
+			panic(http.ErrAbortHandler)
+		}
+		Error(rw, req, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+	}()
+
+	r.hosts.match(req.Host).ServeHTTP(rw, req)
+}
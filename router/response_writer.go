@@ -0,0 +1,89 @@
+package router
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+)
+
+// ResponseWriter records the status and size of a response, for middleware that acts on the response.
+// It still supports flushing and hijacking, when the wrapped ResponseWriter does.
+type ResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+// WrapResponseWriter returns a ResponseWriter recording the response written to w.
+// If w already is one, it is returned as is, so nested middleware share the record.
+func WrapResponseWriter(w http.ResponseWriter) *ResponseWriter {
+	if rw, ok := w.(*ResponseWriter); ok {
+		return rw
+	}
+	return &ResponseWriter{ResponseWriter: w}
+}
+
+// Status returns the status code of the response, or 0 if nothing has been written yet.
+func (rw *ResponseWriter) Status() int {
+	return rw.status
+}
+
+// BytesWritten returns the size of the response body written so far.
+func (rw *ResponseWriter) BytesWritten() int64 {
+	return rw.written
+}
+
+func (rw *ResponseWriter) WriteHeader(status int) {
+	// Informational responses like 103 Early Hints are followed by the actual status
+	if rw.status == 0 && (status >= 200 || status == http.StatusSwitchingProtocols) {
+		rw.status = status
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *ResponseWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	n, err := rw.ResponseWriter.Write(b)
+	rw.written += int64(n)
+	return n, err
+}
+
+// ReadFrom keeps the sendfile optimisation of the wrapped ResponseWriter, used by http.ServeFile.
+func (rw *ResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	var n int64
+	var err error
+	if readerFrom, ok := rw.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = readerFrom.ReadFrom(r)
+	} else {
+		n, err = io.Copy(struct{ io.Writer }{rw.ResponseWriter}, r)
+	}
+	rw.written += n
+	return n, err
+}
+
+func (rw *ResponseWriter) Flush() {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	http.NewResponseController(rw.ResponseWriter).Flush()
+}
+
+// Hijack takes over the connection, e.g. for a WebSocket. The response is then recorded as 101 Switching Protocols.
+func (rw *ResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, buf, err := http.NewResponseController(rw.ResponseWriter).Hijack()
+	if err == nil && rw.status == 0 {
+		rw.status = http.StatusSwitchingProtocols
+	}
+	return conn, buf, err
+}
+
+// Unwrap lets http.ResponseController reach the wrapped ResponseWriter.
+func (rw *ResponseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
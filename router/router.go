@@ -1,10 +1,13 @@
 package router
 
 import (
+	"aspen/auth"
 	"aspen/router/service"
 	"fmt"
 	"net/http"
+	"slices"
 	"sync/atomic"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/rs/zerolog/log"
@@ -15,25 +18,109 @@ var GlobalRouter router
 // Aspen router. Kept private so all instances are made through GlobalRouter.
 type router struct {
 	router atomic.Pointer[RouterInstance]
+
+	// Counts the instances made active, to tell them apart in logs
+	generations atomic.Uint64
+	// Replaced instances finishing their requests
+	drains drains
+}
+
+// Options configures a router instance as a whole.
+type Options struct {
+	// Error pages used when a route has none of its own, and for requests matching no route
+	ErrorPages *ErrorPages
+
+	// ID of a route whose handlers only serve requests that no other route matches, e.g. an SPA fallback.
+	// Its path still applies, so a catch-all like "/*path" serves every unmatched path.
+	NotFound string
+
+	// The httprouter policies, applied to the router of every host. See httprouter.Router for details.
+	HandleMethodNotAllowed bool
+	RedirectTrailingSlash  bool
+	RedirectFixedPath      bool
+	HandleOPTIONS          bool
+
+	// How long the instance may finish its requests once it is replaced, before its services are stopped
+	DrainTimeout time.Duration
+
+	// Users that can log in, for authentication middleware
+	Users *auth.Users
+	// Issues and reads session cookies, for the login resource and session middleware
+	Sessions *auth.Sessions
+	// API keys that machine clients authenticate with
+	APIKeys *auth.APIKeys
+}
+
+// DefaultOptions returns the options of a plain httprouter, without error pages or a NotFound route.
+func DefaultOptions() Options {
+	return Options{
+		HandleMethodNotAllowed: true,
+		RedirectTrailingSlash:  true,
+		RedirectFixedPath:      true,
+		HandleOPTIONS:          true,
+		DrainTimeout:           30 * time.Second,
+	}
 }
 
 type RouterInstance struct {
-	middleware []Middleware
+	options Options
+
+	// Set once the instance is made active
+	generation uint64
+	started    time.Time
+
+	// Requests being handled, and whether the instance has been replaced and is waiting for them to finish.
+	inFlight atomic.Int64
+	draining atomic.Bool
+
+	middleware []MiddlewareFunc
 
 	// Maps service IDs to their respective Service instances.
 	services map[string]*service.Service
 
-	// The actual HTTP router instance that handles requests.
+	// Maps resource IDs to their respective Resource instances.
+	resources map[string]Resource
+
+	// Named transports for upstream connections, shared by the resources that reference them.
+	transports map[string]*http.Transport
+
+	// Hooks run when this instance becomes the active router, and when it is stopped.
+	startHooks []func()
+	stopHooks  []func()
+
+	// The actual HTTP router instance that handles requests to the default host.
 	router *httprouter.Router
+	// Handles requests no other route matched, with the handlers of the NotFound route.
+	notFound *httprouter.Router
+	// Routers for specific hosts, which fall back to the default router.
+	hosts *hostRouters
+	// The router that handlers are added to, the ID of the route adding them, and the route's middleware chain,
+	// while a route is being registered.
+	current           *httprouter.Router
+	currentRoute      string
+	currentMiddleware []MiddlewareFunc
+	currentPages      *ErrorPages
+
+	// Handlers added to each router, and the problems found while adding them.
+	registrations map[*httprouter.Router][]registration
+	issues        ValidationReport
 }
 
-// Creates a new router instance with the provided middleware, services, and resources.
-func NewRouterInstance(middleware []Middleware, services []*service.Service, resources map[string]Resource) *RouterInstance {
+// Creates a new router instance with the provided options, middleware, services, transports, and routes.
+func NewRouterInstance(options Options, middleware []MiddlewareFunc, services []*service.Service, transports map[string]*http.Transport, routes []Route) *RouterInstance {
 	instance := &RouterInstance{
-		middleware: middleware,
-		services:   make(map[string]*service.Service),
-		router:     httprouter.New(),
+		options:       options,
+		middleware:    middleware,
+		services:      make(map[string]*service.Service),
+		resources:     make(map[string]Resource),
+		transports:    transports,
+		registrations: make(map[*httprouter.Router][]registration),
 	}
+	instance.router = instance.newRouter()
+	instance.notFound = instance.newRouter()
+	instance.notFound.NotFound = http.HandlerFunc(notFound)
+	instance.router.NotFound = instance.notFound
+	instance.hosts = newHostRouters(instance.router, instance.newRouter)
 
 	// Map services by their ID
 	for _, service := range services {
@@ -41,45 +128,131 @@ func NewRouterInstance(middleware []Middleware, services []*service.Service, res
 	}
 
 	log.Info().Msg("Creating resource handlers for new router instance:")
-	for path, resource := range resources {
-		err := resource.AddHandlers(path, instance)
+	for _, route := range routes {
+		resource := route.Resource
+		instance.resources[resource.GetID()] = resource
+
+		// Handlers added by the resource go to the router of the route's host, or the NotFound router
+		instance.current = instance.hosts.get(route.Host)
+		if resource.GetID() == options.NotFound {
+			instance.current = instance.notFound
+		}
+		instance.currentRoute = resource.GetID()
+		instance.currentMiddleware = instance.routeMiddleware(route)
+		instance.currentPages = route.ErrorPages
+		err := instance.addHandlers(route)
 		if err != nil {
-			log.Warn().Str("path", path).Err(err).Msg("Error adding handlers")
+			log.Warn().Str("host", route.Host).Str("path", route.Path).Err(err).Msg("Error adding handlers")
+			instance.issues.Add(resource.GetID(), "Resource", "%v", err)
 		} else {
-			log.Info().Str("path", path).Str("id", resource.GetID()).Type("resource", resource).Send()
+			log.Info().Str("host", route.Host).Str("path", route.Path).Str("id", resource.GetID()).Type("resource", resource).Send()
 		}
 	}
+	instance.current = instance.router
+	instance.currentRoute = ""
+	instance.currentMiddleware = instance.middleware
+	instance.currentPages = nil
+
+	if options.NotFound != "" && instance.resources[options.NotFound] == nil {
+		instance.issues.Add("", "Router", "NotFound route \"%s\" doesn't exist", options.NotFound)
+	}
 
 	return instance
 }
 
-// UpdateRouter swaps the global router instance, and stops the old instance.
+// newRouter creates a router with the options of this instance. Unmatched requests get a 404 error page.
+func (r *RouterInstance) newRouter() *httprouter.Router {
+	router := httprouter.New()
+	router.HandleMethodNotAllowed = r.options.HandleMethodNotAllowed
+	router.RedirectTrailingSlash = r.options.RedirectTrailingSlash
+	router.RedirectFixedPath = r.options.RedirectFixedPath
+	router.HandleOPTIONS = r.options.HandleOPTIONS
+	router.NotFound = http.HandlerFunc(notFound)
+	router.MethodNotAllowed = http.HandlerFunc(methodNotAllowed)
+	return router
+}
+
+// routeMiddleware returns the middleware chain of a route.
+func (r *RouterInstance) routeMiddleware(route Route) []MiddlewareFunc {
+	if route.OverrideMiddleware {
+		return route.Middleware
+	}
+	return append(slices.Clip(r.middleware), route.Middleware...)
+}
+
+// addHandlers adds the handlers of a route's resource, turning a panic into an error.
+func (r *RouterInstance) addHandlers(route Route) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("panic while adding handlers: %v", recovered)
+		}
+	}()
+
+	return route.Resource.AddHandlers(route.Path, r)
+}
+
+// UpdateRouter swaps the global router instance. The old instance is stopped in the background,
+// once its requests in flight are done or its drain timeout passes.
 func UpdateRouter(instance *RouterInstance) {
-	log.Info().Msg("Updating global router instance")
+	instance.generation = GlobalRouter.generations.Add(1)
+	instance.started = time.Now()
+	log.Info().Uint64("generation", instance.generation).Msg("Updating global router instance")
+
+	instance.runHooks(instance.startHooks)
 	old := GlobalRouter.router.Swap(instance)
 	if old != nil {
-		log.Info().Msg("Stopping old router instance services")
-		if err := old.StopServices(); err != nil {
-			log.Error().Err(err).Msg("Error stopping old router instance services")
-		}
+		GlobalRouter.drains.start(old)
 	}
 }
 
 // ServeHTTP forwards the request to the current router instance to handle.
 func (r *router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	router := r.router.Load()
-	if router == nil {
-		log.Fatal().Msg("Router is not initialized")
+	for {
+		router := r.router.Load()
+		if router == nil {
+			log.Fatal().Msg("Router is not initialized")
+		}
+
+		// Count the request before checking for a drain, so the drain either sees the request,
+		// or the request sees the drain and moves to the new instance
+		router.inFlight.Add(1)
+		if router.draining.Load() && r.router.Load() != nil {
+			router.inFlight.Add(-1)
+			continue
+		}
+
+		defer router.inFlight.Add(-1)
+		router.serve(w, req)
+		return
 	}
+}
+
+// Status returns the request counts of the active router instance and the instances still draining.
+func (r *router) Status() RouterStatus {
+	status := RouterStatus{Draining: r.drains.statuses()}
+	if router := r.router.Load(); router != nil {
+		active := router.status()
+		status.Active = &active
+	}
+	return status
+}
 
-	router.router.ServeHTTP(w, req)
+func notFound(w http.ResponseWriter, req *http.Request) {
+	Error(w, req, http.StatusNotFound, "404 page not found")
+}
+
+func methodNotAllowed(w http.ResponseWriter, req *http.Request) {
+	Error(w, req, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
 }
 
 func (r *router) Shutdown() error {
 	log.Info().Msg("Shutting down global router instance")
 	router := r.router.Swap(nil)
+
+	// The server has stopped taking requests, so there is nothing left worth waiting for
+	r.drains.stopAll()
 	if router != nil {
-		if err := router.StopServices(); err != nil {
+		if err := router.Stop(); err != nil {
 			return fmt.Errorf("error stopping services during shutdown: %v", err)
 		}
 	}
@@ -92,6 +265,66 @@ func (r *RouterInstance) GetService(id string) *service.Service {
 	return r.services[id]
 }
 
+// Users returns the user store of the router instance.
+func (r *RouterInstance) Users() *auth.Users {
+	return r.options.Users
+}
+
+// APIKeys returns the API key store of the router instance, which may be nil.
+func (r *RouterInstance) APIKeys() *auth.APIKeys {
+	return r.options.APIKeys
+}
+
+// Sessions returns the session cookie issuer of the instance, which may be nil.
+func (r *RouterInstance) Sessions() *auth.Sessions {
+	return r.options.Sessions
+}
+
+// GetTransport retrieves a named transport from the router instance.
+func (r *RouterInstance) GetTransport(name string) *http.Transport {
+	return r.transports[name]
+}
+
+// GetResource retrieves a resource by its ID from the router instance.
+func (r *RouterInstance) GetResource(id string) Resource {
+	return r.resources[id]
+}
+
+// Resources returns every resource in the router instance.
+func (r *RouterInstance) Resources() []Resource {
+	resources := make([]Resource, 0, len(r.resources))
+	for _, resource := range r.resources {
+		resources = append(resources, resource)
+	}
+	return resources
+}
+
+// OnStart registers a hook that runs when this instance becomes the active router.
+// Resources use this to start background work, since instances are also created just to validate a config.
+func (r *RouterInstance) OnStart(hook func()) {
+	r.startHooks = append(r.startHooks, hook)
+}
+
+// OnStop registers a hook that runs when this instance is replaced or shut down.
+func (r *RouterInstance) OnStop(hook func()) {
+	r.stopHooks = append(r.stopHooks, hook)
+}
+
+func (r *RouterInstance) runHooks(hooks []func()) {
+	for _, hook := range hooks {
+		hook()
+	}
+}
+
+// Stop runs the stop hooks of this instance, closes idle upstream connections, then stops its services.
+func (r *RouterInstance) Stop() error {
+	r.runHooks(r.stopHooks)
+	for _, transport := range r.transports {
+		transport.CloseIdleConnections()
+	}
+	return r.StopServices()
+}
+
 // BuildServices builds each service for this router instance.
 func (r *RouterInstance) BuildServices() error {
 	for id, service := range r.services {
@@ -133,20 +366,7 @@ func (r *RouterInstance) StopServices() error {
 
 // Handle assigns a resource and handler to a specific method and path.
 func (r *RouterInstance) Handle(method, path string, resource BaseResource, handle httprouter.Handle) {
-	handleWithMiddleware := func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
-		// Execute middleware in the order they were added
-		for _, middleware := range r.middleware {
-			if err, err_code := middleware.Handle(resource, w, req, ps); err != nil {
-				http.Error(w, err.Error(), err_code)
-				return
-			}
-		}
-
-		// Call the resource handler
-		handle(w, req, ps)
-	}
-
-	r.router.Handle(method, path, handleWithMiddleware)
+	r.register(method, path, chain(r.currentMiddleware, r.currentPages, resource, handle))
 }
 
 // GET wraps the Handle method for GET requests.
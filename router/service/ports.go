@@ -0,0 +1,108 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// composePublisher is a published port, as reported by `docker compose ps --format json`.
+type composePublisher struct {
+	URL           string
+	TargetPort    int
+	PublishedPort int
+	Protocol      string
+}
+
+type composeContainer struct {
+	Service    string
+	Publishers []composePublisher
+}
+
+// Address looks up the host address ("host:port") the service can be reached on.
+// If the service declares a port, that is used, otherwise its published ports are inspected.
+//
+// composeService and port select which compose service and container port to look up. If either is
+// empty, the first published TCP port matching the other is used, so a service with a single published
+// port needs neither.
+func (s *Service) Address(composeService string, port int) (string, error) {
+	if status := s.GetStatus(); status != Started {
+		return "", fmt.Errorf("service %s is not running, current status is %s", s.id, status)
+	}
+
+	if s.port != 0 && composeService == "" && port == 0 {
+		return net.JoinHostPort("127.0.0.1", strconv.Itoa(s.port)), nil
+	}
+
+	cmd := exec.Command("docker", "compose", "ps", "--format", "json")
+	cmd.Dir = s.repo.folder
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("error listing containers of service %s: %w, output: %s", s.id, err, string(output))
+	}
+
+	containers, err := parseComposePs(output)
+	if err != nil {
+		return "", fmt.Errorf("error parsing containers of service %s: %w", s.id, err)
+	}
+
+	for _, container := range containers {
+		if composeService != "" && container.Service != composeService {
+			continue
+		}
+		for _, publisher := range container.Publishers {
+			if publisher.PublishedPort == 0 || (publisher.Protocol != "" && publisher.Protocol != "tcp") {
+				continue
+			}
+			if port != 0 && publisher.TargetPort != port {
+				continue
+			}
+			return net.JoinHostPort(publishedHost(publisher.URL), strconv.Itoa(publisher.PublishedPort)), nil
+		}
+	}
+
+	return "", fmt.Errorf("service %s has no published port matching service '%s' and port %d", s.id, composeService, port)
+}
+
+// parseComposePs parses the output of `docker compose ps --format json`.
+// Depending on the compose version this is either a JSON array, or one JSON object per line.
+func parseComposePs(output []byte) ([]composeContainer, error) {
+	output = bytes.TrimSpace(output)
+	if len(output) == 0 {
+		return nil, nil
+	}
+
+	var containers []composeContainer
+	if output[0] == '[' {
+		err := json.Unmarshal(output, &containers)
+		return containers, err
+	}
+
+	for _, line := range bytes.Split(output, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var container composeContainer
+		if err := json.Unmarshal(line, &container); err != nil {
+			return nil, err
+		}
+		containers = append(containers, container)
+	}
+	return containers, nil
+}
+
+// publishedHost turns the address a port is bound to into one we can connect to.
+func publishedHost(bound string) string {
+	switch strings.Trim(bound, "[]") {
+	case "", "0.0.0.0":
+		return "127.0.0.1"
+	case "::":
+		return "::1"
+	default:
+		return strings.Trim(bound, "[]")
+	}
+}
@@ -25,18 +25,25 @@ const (
 )
 
 type Service struct {
-	id     string
-	status Status
+	id string
+
+	// Status is read by request handlers while the service is started and stopped, so it is locked
+	status     Status
+	statusLock sync.RWMutex
 
 	// Remote git repo that contains the service code
 	repo Repo
+
+	// Host port the service listens on, if declared. Otherwise it is looked up from the published ports.
+	port int
 }
 
-func NewService(id, remote, commitHash string) *Service {
+func NewService(id, remote, commitHash string, port int) *Service {
 	return &Service{
 		id:     id,
 		status: NotInitialized,
 		repo:   NewRepo(getServiceFolder(id), remote, commitHash),
+		port:   port,
 	}
 }
 
@@ -45,18 +52,26 @@ func (s *Service) GetID() string {
 }
 
 func (s *Service) GetStatus() Status {
+	s.statusLock.RLock()
+	defer s.statusLock.RUnlock()
 	return s.status
 }
 
+func (s *Service) setStatus(status Status) {
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+	s.status = status
+}
+
 // Build initializes the service by cloning the source code and building the docker image.
 // If the currently built image is out of date, this will update it.
 // This method should be called once before starting the service.
 func (s *Service) Build() error {
-	if s.status != NotInitialized {
-		return fmt.Errorf("trying to build service %s again, current status is %s", s.id, s.status)
+	if status := s.GetStatus(); status != NotInitialized {
+		return fmt.Errorf("trying to build service %s again, current status is %s", s.id, status)
 	}
 	log.Info().Str("service", s.id).Msg("Building service")
-	s.status = Building
+	s.setStatus(Building)
 
 	// First clone repo if it's not up to date
 	if !s.repo.Updated() {
@@ -71,7 +86,7 @@ func (s *Service) Build() error {
 		return fmt.Errorf("error building service %s: %w, output: %s", s.id, err, string(output))
 	}
 
-	s.status = Built
+	s.setStatus(Built)
 	return nil
 }
 
@@ -79,11 +94,11 @@ func (s *Service) Build() error {
 // If an outdated version is running, this will reload it with the updated version.
 // This method should be called once after Build; if called multiple times, it will return an error.
 func (s *Service) Start() error {
-	if s.status != Built {
-		return fmt.Errorf("trying to build unbuilt or already started service %s, current status is %s", s.id, s.status)
+	if status := s.GetStatus(); status != Built {
+		return fmt.Errorf("trying to build unbuilt or already started service %s, current status is %s", s.id, status)
 	}
 	log.Info().Str("service", s.id).Msg("Starting service")
-	s.status = Starting
+	s.setStatus(Starting)
 
 	// First update ref count to ensure the service isn't killed while starting
 	runningServicesLock.Lock()
@@ -98,7 +113,7 @@ func (s *Service) Start() error {
 		return fmt.Errorf("error starting service %s: %w, output: %s", s.id, err, string(output))
 	}
 
-	s.status = Started
+	s.setStatus(Started)
 
 	return nil
 }
@@ -106,11 +121,11 @@ func (s *Service) Start() error {
 // Stop decrements the ref count for this service and, if the count reaches zero, stops the service.
 // This method should be called once after Start; if called multiple times, it will return an error.
 func (s *Service) Stop() error {
-	if s.status != Started {
-		return fmt.Errorf("trying to stop not-running service %s, current status is %s", s.id, s.status)
+	if status := s.GetStatus(); status != Started {
+		return fmt.Errorf("trying to stop not-running service %s, current status is %s", s.id, status)
 	}
 	log.Info().Str("service", s.id).Msg("Stopping service")
-	s.status = Stopping
+	s.setStatus(Stopping)
 
 	// Decrease ref count, and if it reaches zero, stop the service
 	runningServicesLock.Lock()
@@ -130,7 +145,7 @@ func (s *Service) Stop() error {
 			return fmt.Errorf("error stopping service %s: %w, output: %s", s.id, err, string(output))
 		}
 	}
-	s.status = Stopped
+	s.setStatus(Stopped)
 
 	return nil
 }
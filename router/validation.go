@@ -0,0 +1,113 @@
+package router
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// ValidationIssue is a problem with a config, found before it is applied.
+type ValidationIssue struct {
+	// ID of the route with the problem, empty for problems outside the routes
+	Route   string `json:"route"`
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (vi ValidationIssue) String() string {
+	if vi.Route == "" {
+		return fmt.Sprintf("%s: %s", vi.Field, vi.Message)
+	}
+	return fmt.Sprintf("route \"%s\" %s: %s", vi.Route, vi.Field, vi.Message)
+}
+
+// ValidationReport is the error returned for a config with one or more issues.
+type ValidationReport struct {
+	Issues []ValidationIssue `json:"issues"`
+}
+
+func (vr *ValidationReport) Error() string {
+	messages := make([]string, len(vr.Issues))
+	for i, issue := range vr.Issues {
+		messages[i] = issue.String()
+	}
+	return fmt.Sprintf("config has %d issue(s): %s", len(vr.Issues), strings.Join(messages, "; "))
+}
+
+// Add records an issue in the report.
+func (vr *ValidationReport) Add(route, field, format string, args ...any) {
+	vr.Issues = append(vr.Issues, ValidationIssue{
+		Route:   route,
+		Field:   field,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// Err returns the report as an error, or nil if it has no issues.
+func (vr *ValidationReport) Err() error {
+	if len(vr.Issues) == 0 {
+		return nil
+	}
+	return vr
+}
+
+// registration is a handler added by a route, kept to explain conflicts with later handlers.
+type registration struct {
+	route  string
+	method string
+	path   string
+}
+
+// register adds a handler to the current router. httprouter panics when a path conflicts with an existing one,
+// so the panic is recovered and recorded as an issue with the route that registered the conflicting path.
+func (r *RouterInstance) register(method, path string, handle httprouter.Handle) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			message := fmt.Sprint(recovered)
+			if other, ok := r.findConflict(method, path); ok {
+				message = fmt.Sprintf("%s %s conflicts with %s %s of route \"%s\"", method, path, other.method, other.path, other.route)
+			}
+			r.issues.Add(r.currentRoute, "Route", "%s", message)
+		}
+	}()
+
+	r.current.Handle(method, path, handle)
+	r.registrations[r.current] = append(r.registrations[r.current], registration{
+		route:  r.currentRoute,
+		method: method,
+		path:   path,
+	})
+}
+
+// findConflict looks for the earlier registration on the current router that a path conflicts with.
+func (r *RouterInstance) findConflict(method, path string) (registration, bool) {
+	for _, other := range r.registrations[r.current] {
+		if other.method == method && conflicts(method, other.path, path) {
+			return other, true
+		}
+	}
+	return registration{}, false
+}
+
+// conflicts reports whether httprouter refuses to add both paths for the same method.
+func conflicts(method, first, second string) (conflict bool) {
+	defer func() {
+		if recover() != nil {
+			conflict = true
+		}
+	}()
+
+	noop := func(http.ResponseWriter, *http.Request, httprouter.Params) {}
+	router := httprouter.New()
+	router.Handle(method, first, noop)
+	router.Handle(method, second, noop)
+	return false
+}
+
+// Issues returns the problems found while adding the handlers of each route.
+// An instance with issues is missing handlers, and should not be used.
+func (r *RouterInstance) Issues() []ValidationIssue {
+	return r.issues.Issues
+}
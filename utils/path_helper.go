@@ -133,6 +133,39 @@ func (p Path) ConstructPath(variables httprouter.Params) string {
 	return sb.String()
 }
 
+// Match checks if the given concrete path matches this path, and returns the values of its variables.
+// It is the reverse of ConstructPath, so a path can be mapped from one pattern onto another.
+func (p Path) Match(path string) (httprouter.Params, bool) {
+	segments := strings.Split(path, "/")
+	var variables httprouter.Params
+
+	for i, segment := range p {
+		switch segment.Type {
+		case FIXED_SEGMENT:
+			if i >= len(segments) || segments[i] != segment.Value {
+				return nil, false
+			}
+
+		case NAMED_SEGMENT:
+			if i >= len(segments) || segments[i] == "" {
+				return nil, false
+			}
+			variables = append(variables, httprouter.Param{Key: segment.Value, Value: segments[i]})
+
+		case CATCH_ALL_SEGMENT:
+			// Catch-all segments capture the rest of the path, including the leading '/'
+			rest := "/"
+			if i < len(segments) {
+				rest += strings.Join(segments[i:], "/")
+			}
+			variables = append(variables, httprouter.Param{Key: segment.Value, Value: rest})
+			return variables, true
+		}
+	}
+
+	return variables, len(segments) == len(p)
+}
+
 func (p Path) String() string {
 	// Join the segments into a string, using '/' as the separator
 	var sb strings.Builder